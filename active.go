@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Only this many of the most recently visited objects are ranked
+	maxActiveCandidates = 1000
+
+	activeWriteTimeout = 10 * time.Second
+
+	// Scores every recently visited object by when it was last visited. No
+	// onlineKey can be spelled this way.
+	onlineObjectsKey = "onlineobjects"
+)
+
+type ActiveObjectJSON struct {
+	ID       string `json:"id"`
+	Visitors int64  `json:"visitors"`
+}
+
+// ActiveJSON counts the visitors seen in the last Window seconds, on the
+// objects asked for and on the most active ones.
+type ActiveJSON struct {
+	Window  int64              `json:"window"`
+	Objects map[string]int64   `json:"objects,omitempty"`
+	Top     []ActiveObjectJSON `json:"top"`
+}
+
+// onlineKey scores each of an object's recent visitors by when they were
+// last seen.
+func onlineKey(objectID string) string {
+	return "online_" + objectID
+}
+
+func trackActive(conn redis.Conn, event *Event) {
+	now := event.time().Unix()
+	window := int64(activeWindow() / time.Second)
+	conn.Send("ZADD", onlineKey(event.Object), now, event.User)
+	conn.Send("ZREMRANGEBYSCORE", onlineKey(event.Object), "-inf", now-window)
+	conn.Send("EXPIRE", onlineKey(event.Object), window)
+	conn.Send("ZADD", onlineObjectsKey, now, event.Object)
+	conn.Send("ZREMRANGEBYSCORE", onlineObjectsKey, "-inf", now-window)
+}
+
+// GetActive counts the visitors active on ids, and ranks the limit most
+// active objects, as of now.
+func GetActive(site *Site, ids []string, now time.Time, limit int) (aj ActiveJSON, err error) {
+	return getActive(site, ids, now, limit, nil)
+}
+
+// getActive leaves objects matching the hidden private patterns out of the
+// ranking.
+func getActive(site *Site, ids []string, now time.Time, limit int, hidden []string) (aj ActiveJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	window := int64(activeWindow() / time.Second)
+	since := strconv.FormatInt(now.Unix()-window, 10)
+	aj = ActiveJSON{Window: window, Top: []ActiveObjectJSON{}}
+
+	candidates, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE", onlineObjectsKey, "+inf", "("+since, "LIMIT", 0, maxActiveCandidates))
+	if err != nil {
+		return aj, err
+	}
+	for _, id := range candidates {
+		if !isPrivate(hidden, id) {
+			conn.Send("ZCOUNT", onlineKey(id), "("+since, "+inf")
+		}
+	}
+	for _, id := range ids {
+		conn.Send("ZCOUNT", onlineKey(id), "("+since, "+inf")
+	}
+	conn.Flush()
+
+	for _, id := range candidates {
+		if isPrivate(hidden, id) {
+			continue
+		}
+		visitors, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return aj, err
+		}
+		if visitors > 0 {
+			aj.Top = append(aj.Top, ActiveObjectJSON{ID: id, Visitors: visitors})
+		}
+	}
+	sort.Sort(byVisitors(aj.Top))
+	if len(aj.Top) > limit {
+		aj.Top = aj.Top[:limit]
+	}
+
+	if len(ids) > 0 {
+		aj.Objects = make(map[string]int64, len(ids))
+	}
+	for _, id := range ids {
+		if aj.Objects[id], err = redis.Int64(conn.Receive()); err != nil {
+			return aj, err
+		}
+	}
+	return aj, nil
+}
+
+type byVisitors []ActiveObjectJSON
+
+func (s byVisitors) Len() int      { return len(s) }
+func (s byVisitors) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byVisitors) Less(i, j int) bool {
+	if s[i].Visitors != s[j].Visitors {
+		return s[i].Visitors > s[j].Visitors
+	}
+	return s[i].ID < s[j].ID
+}
+
+// allowsOrigin checks a WebSocket handshake against the site's CORS policy
+// for reads, since browsers don't apply CORS to WebSockets themselves.
+func allowsOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	policy := siteFor(req).corsPolicy("read")
+	for _, allowed := range policy.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+var activeUpgrader = websocket.Upgrader{CheckOrigin: allowsOrigin}
+
+// apiActiveHandler pushes the active visitors on the objects given as id
+// parameters, and the most active objects, over a WebSocket every
+// ACTIVE_INTERVAL seconds.
+func apiActiveHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var ids []string
+	for _, list := range query["id"] {
+		for _, id := range strings.Split(list, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) > maxMultiIDs {
+		jsonError(w, fmt.Sprintf("Must pass at most %d ids", maxMultiIDs), http.StatusBadRequest)
+		return
+	}
+	limit := defaultTopLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxTopLimit {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	public, err := publicObjects(req, ids)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(public) < len(ids) {
+		jsonError(w, "Some of these objects are private; pass a read key", http.StatusUnauthorized)
+		return
+	}
+	var hidden []string
+	if ok, err := canReadAll(req); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		conn := siteFor(req).Conn()
+		hidden, err = privatePatterns(conn)
+		conn.Close()
+		if err != nil {
+			fmt.Print(err)
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if atomic.AddInt64(&liveConnections, 1) > liveMaxConnections() {
+		atomic.AddInt64(&liveConnections, -1)
+		w.Header().Set("Retry-After", "30")
+		jsonError(w, "Too many live connections; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt64(&liveConnections, -1)
+
+	ws, err := activeUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader has already replied
+		return
+	}
+	defer ws.Close()
+
+	// Clients only ever send control frames, but reading is how those, and
+	// the connection closing, are noticed.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	site := siteFor(req)
+	ticker := time.NewTicker(activeInterval())
+	defer ticker.Stop()
+	for {
+		active, err := getActive(site, ids, time.Now(), limit, hidden)
+		if err != nil {
+			fmt.Print(err)
+		} else {
+			ws.SetWriteDeadline(time.Now().Add(activeWriteTimeout))
+			if err := ws.WriteJSON(active); err != nil {
+				return
+			}
+		}
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
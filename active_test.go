@@ -0,0 +1,75 @@
+package main_test
+
+import (
+	"github.com/gorilla/websocket"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Active visitors", func() {
+	BeforeEach(func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "foo", User: "jelder", Time: time.Now().Add(-10 * time.Minute)},
+			{Object: "foo", User: "cmbt"},
+			{Object: "foo", User: "cmbt"},
+			{Object: "bar", User: "jelder"},
+			{Object: "bar", User: "cmbt"},
+			{Object: "baz", User: "jelder"},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+	})
+	AfterEach(resetRedis)
+
+	It("should count visitors within the window", func() {
+		active, _ := GetActive(DefaultSite, []string{"foo", "qux"}, time.Now(), 2)
+		Expect(active.Window).To(Equal(int64(300)))
+		Expect(active.Objects).To(Equal(map[string]int64{"foo": 1, "qux": 0}))
+		Expect(active.Top).To(Equal([]ActiveObjectJSON{{ID: "bar", Visitors: 2}, {ID: "baz", Visitors: 1}}))
+	})
+
+	It("should keep an object called objects apart from the ranking", func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		event := Event{Object: "objects", User: "jelder"}
+		event.Track(conn)
+		active, _ := GetActive(DefaultSite, []string{"objects"}, time.Now(), 10)
+		Expect(active.Objects).To(Equal(map[string]int64{"objects": 1}))
+		Expect(active.Top).To(HaveLen(4))
+	})
+
+	It("should push counts over a WebSocket", func() {
+		server := httptest.NewServer(Router())
+		defer server.Close()
+
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/_active?id=foo"
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer ws.Close()
+
+		var active ActiveJSON
+		Expect(ws.ReadJSON(&active)).To(Succeed())
+		Expect(active.Objects["foo"]).To(Equal(int64(1)))
+		Expect(active.Top).To(HaveLen(3))
+	})
+
+	It("should refuse origins the site doesn't allow", func() {
+		ENV["CORS_READ_ORIGINS"] = "https://www.example.com"
+		defer delete(ENV, "CORS_READ_ORIGINS")
+		server := httptest.NewServer(Router())
+		defer server.Close()
+
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/_active"
+		_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}})
+		Expect(err).To(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+})
@@ -8,11 +8,52 @@ import (
 	"github.com/mholt/binding"
 	// "io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Lua's unpack, used by multi.lua, has a limited stack.
+const maxMultiIDs = 1000
+
 type TrackJSON struct {
-	Visits  int64 `json:"visits"`
-	Uniques int64 `json:"uniques"`
+	Visits  int64                `json:"visits"`
+	Uniques int64                `json:"uniques"`
+	Objects map[string]TrackJSON `json:"objects,omitempty"`
+}
+
+type MultiJSON struct {
+	IDs       []string `json:"ids"`
+	Breakdown bool     `json:"breakdown"`
+}
+
+// ErrorJSON is the envelope for every error the API reports as JSON.
+type ErrorJSON struct {
+	Error string `json:"error"`
+}
+
+func jsonError(w http.ResponseWriter, message string, code int) {
+	js, _ := json.MarshalIndent(ErrorJSON{Error: message}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+// bind reads a request body into v like binding.Bind, reporting any errors in
+// the API's envelope. It returns false if it did.
+func bind(w http.ResponseWriter, req *http.Request, v binding.FieldMapper) bool {
+	errs := binding.Bind(req, v)
+	if errs.Len() == 0 {
+		return true
+	}
+	code := binding.StatusUnprocessableEntity
+	if errs.Has(binding.DeserializationError) {
+		code = http.StatusBadRequest
+	} else if errs.Has(binding.ContentTypeError) {
+		code = http.StatusUnsupportedMediaType
+	}
+	jsonError(w, errs.Error(), code)
+	return false
 }
 
 func (TrackJSON *TrackJSON) FieldMap() binding.FieldMap {
@@ -23,88 +64,175 @@ func (TrackJSON *TrackJSON) FieldMap() binding.FieldMap {
 }
 
 func apiHandler(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	objectID := vars["objectID"]
-	conn := RedisPool.Get()
+	site := siteFor(req)
+	objectID := mux.Vars(req)["objectID"]
+	js, err := cachedJSON(site.prefix()+"object_"+objectID, func() (interface{}, error) {
+		return Get(site, objectID)
+	})
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeCacheableJSON(w, req, js)
+}
+
+// Get returns an object's live visits and uniques plus any migrated totals.
+func Get(site *Site, objectID string) (tj TrackJSON, err error) {
+	conn := site.Conn()
 	defer conn.Close()
 
 	uniques, err := redis.Int64(conn.Do("PFCOUNT", "hll_"+objectID))
 	if err != nil {
-		fmt.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return tj, err
 	}
 
 	var migratedVisits, migratedUniques, visits int64
 	mget, err := redis.Values(conn.Do("MGET", "visits_"+objectID, "uniques_"+objectID, "hits_"+objectID))
 	if err != nil {
-		fmt.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return tj, err
 	}
 	if _, err := redis.Scan(mget, &migratedVisits, &migratedUniques, &visits); err != nil {
-		fmt.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return tj, err
 	}
 	visits += migratedVisits
 	uniques += migratedUniques
 
-	apiResponse := TrackJSON{Visits: visits, Uniques: uniques}
-	js, _ := json.MarshalIndent(apiResponse, "", "  ")
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	return TrackJSON{Visits: visits, Uniques: uniques}, nil
 }
 
 func apiMultiHandler(w http.ResponseWriter, req *http.Request) {
-	req.ParseForm()
+	multi, err := parseMultiRequest(req)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if len(req.Form["id"]) < 1 {
-		http.Error(w, "Must pass id parameter (at least once)", http.StatusBadRequest)
+	public, err := publicObjects(req, multi.IDs)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(public) < len(multi.IDs) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="beacon"`)
+		jsonError(w, "Some of these objects are private; pass a read key", http.StatusUnauthorized)
 		return
 	}
 
-	response, err := GetMulti(req.Form["id"])
+	site := siteFor(req)
+	ids := append([]string{}, multi.IDs...)
+	sort.Strings(ids)
+	key := site.prefix() + "multi_" + strconv.FormatBool(multi.Breakdown) + "_" + strings.Join(ids, ",")
+	js, err := cachedJSON(key, func() (interface{}, error) {
+		return GetMulti(site, multi.IDs, multi.Breakdown)
+	})
 	if err != nil {
 		fmt.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeCacheableJSON(w, req, js)
+}
 
-	js, _ := json.MarshalIndent(response, "", "  ")
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+// parseMultiRequest accepts ids as a JSON body, or as id parameters in the
+// query string or a form body. Each id parameter may itself be a comma
+// separated list.
+func parseMultiRequest(req *http.Request) (multi MultiJSON, err error) {
+	if strings.Contains(req.Header.Get("Content-Type"), "json") {
+		if err := json.NewDecoder(req.Body).Decode(&multi); err != nil {
+			return multi, fmt.Errorf("Invalid JSON body: %s", err)
+		}
+	}
+	if err := req.ParseForm(); err != nil {
+		return multi, err
+	}
+	for _, list := range req.Form["id"] {
+		multi.IDs = append(multi.IDs, strings.Split(list, ",")...)
+	}
+	if breakdown := req.Form.Get("breakdown"); breakdown != "" {
+		if multi.Breakdown, err = strconv.ParseBool(breakdown); err != nil {
+			return multi, fmt.Errorf("breakdown must be true or false")
+		}
+	}
+
+	// Objects asked for twice would be counted twice
+	ids := multi.IDs[:0]
+	seen := map[string]bool{}
+	for _, id := range multi.IDs {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	multi.IDs = ids
+	if len(multi.IDs) < 1 {
+		return multi, fmt.Errorf("Must pass at least one id")
+	}
+	if len(multi.IDs) > maxMultiIDs {
+		return multi, fmt.Errorf("Must pass at most %d ids", maxMultiIDs)
+	}
+	return multi, nil
 }
 
-func GetMulti(ids []string) (tj TrackJSON, err error) {
-	conn := RedisPool.Get()
+// GetMulti sums visits across ids and counts the uniques of their union. With
+// breakdown, each object's own visits and uniques are returned alongside.
+//
+// Migrated totals are included just as Get includes them. Migrated uniques
+// are only counts, so they can't be unioned with the live HyperLogLogs or each
+// other; they are added on top, treating imported audiences as disjoint.
+func GetMulti(site *Site, ids []string, breakdown bool) (tj TrackJSON, err error) {
+	conn := site.Conn()
 	defer conn.Close()
 
-	scriptArgs := redis.Args{}.Add(len(ids)).AddFlat(ids)
-	// var visits, uniques int64
+	breakdownArg := "0"
+	if breakdown {
+		breakdownArg = "1"
+	}
+	scriptArgs := redis.Args{}.Add(len(ids)).AddFlat(ids).Add(breakdownArg, site.prefix())
 	scriptResult, err := redis.Values(multiScript.Do(conn, scriptArgs...))
 	if err != nil {
 		return tj, err
 	}
-	_, err = redis.Scan(scriptResult, &tj.Visits, &tj.Uniques)
+	var objects []interface{}
+	_, err = redis.Scan(scriptResult, &tj.Visits, &tj.Uniques, &objects)
 	if err != nil {
 		return tj, err
 	}
-	return tj, err
+	if !breakdown {
+		return tj, nil
+	}
+
+	tj.Objects = make(map[string]TrackJSON)
+	for len(objects) > 0 {
+		var id string
+		var object TrackJSON
+		objects, err = redis.Scan(objects, &id, &object.Visits, &object.Uniques)
+		if err != nil {
+			return tj, err
+		}
+		tj.Objects[id] = object
+	}
+	return tj, nil
 }
 
 func apiWriteHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	objectID := vars["objectID"]
 	TrackJSON := new(TrackJSON)
-	if binding.Bind(req, TrackJSON).Handle(w) {
+	if !bind(w, req, TrackJSON) {
 		return
 	}
-	fmt.Sprintf("%q\n", TrackJSON)
-	conn := RedisPool.Get()
-	defer conn.Close()
-	_, err := conn.Do("MSET", "uniques_"+objectID, TrackJSON.Uniques, "visits_"+objectID, TrackJSON.Visits)
-	if err != nil {
+	if err := SetMigrated(siteFor(req), vars["objectID"], *TrackJSON); err != nil {
 		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// SetMigrated records visits and uniques imported from another platform,
+// replacing any previously migrated totals.
+func SetMigrated(site *Site, objectID string, tj TrackJSON) error {
+	conn := site.Conn()
+	defer conn.Close()
+	_, err := conn.Do("MSET", "uniques_"+objectID, tj.Uniques, "visits_"+objectID, tj.Visits)
+	return err
+}
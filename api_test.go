@@ -1,13 +1,20 @@
 package main_test
 
 import (
+	"encoding/json"
 	. "github.com/jelder/beacon"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 func TestEnv(t *testing.T) {
+	// Specs flush Redis between them, which the tracker wouldn't notice if it
+	// cached definitions
+	ENV["DEFINITIONS_TTL"] = "0"
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "API")
 	BeforeSuite(resetRedis)
@@ -20,6 +27,16 @@ func resetRedis() {
 	conn.Do("FLUSHALL")
 }
 
+func request(method, url, contentType, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	Router().ServeHTTP(w, req)
+	return w
+}
+
 func trackSomeEvents() {
 	conn := RedisPool.Get()
 	defer conn.Close()
@@ -45,7 +62,7 @@ var _ = Describe("API", func() {
 		var result TrackJSON
 
 		BeforeEach(func() {
-			result, _ = GetMulti([]string{"foo", "bar"})
+			result, _ = GetMulti(DefaultSite, []string{"foo", "bar"}, false)
 		})
 
 		It("should find our uniques", func() {
@@ -55,5 +72,121 @@ var _ = Describe("API", func() {
 		It("should find our visits", func() {
 			Expect(result.Visits).To(Equal(int64(40)))
 		})
+
+		It("should not break down by object unless asked", func() {
+			Expect(result.Objects).To(BeNil())
+		})
+
+		Context("with breakdown", func() {
+			BeforeEach(func() {
+				result, _ = GetMulti(DefaultSite, []string{"foo", "bar", "baz"}, true)
+			})
+
+			It("should still find our union uniques", func() {
+				Expect(result.Uniques).To(Equal(int64(2)))
+			})
+
+			It("should find each object's own visits and uniques", func() {
+				Expect(result.Objects).To(Equal(map[string]TrackJSON{
+					"foo": {Visits: 20, Uniques: 2},
+					"bar": {Visits: 20, Uniques: 2},
+					"baz": {Visits: 0, Uniques: 0},
+				}))
+			})
+		})
+	})
+
+	Describe("migrated totals", func() {
+		BeforeEach(func() {
+			SetMigrated(DefaultSite, "foo", TrackJSON{Visits: 100, Uniques: 30})
+			SetMigrated(DefaultSite, "baz", TrackJSON{Visits: 7, Uniques: 3})
+		})
+
+		It("should add migrated totals to the single-object API", func() {
+			result, _ := Get(DefaultSite, "foo")
+			Expect(result).To(Equal(TrackJSON{Visits: 120, Uniques: 32}))
+		})
+
+		It("should report the same numbers for one object via _multi", func() {
+			for _, id := range []string{"foo", "bar", "baz"} {
+				single, _ := Get(DefaultSite, id)
+				multi, _ := GetMulti(DefaultSite, []string{id}, false)
+				Expect(multi).To(Equal(single))
+			}
+		})
+
+		It("should report the same numbers per object in a _multi breakdown", func() {
+			multi, _ := GetMulti(DefaultSite, []string{"foo", "bar", "baz"}, true)
+			for id, object := range multi.Objects {
+				single, _ := Get(DefaultSite, id)
+				Expect(object).To(Equal(single))
+			}
+		})
+
+		It("should add migrated uniques on top of the live union", func() {
+			multi, _ := GetMulti(DefaultSite, []string{"foo", "bar", "baz"}, false)
+			Expect(multi).To(Equal(TrackJSON{Visits: 147, Uniques: 35}))
+		})
+	})
+
+	Describe("api/v1/_multi requests", func() {
+		var w *httptest.ResponseRecorder
+
+		multiResult := func() (tj TrackJSON) {
+			json.Unmarshal(w.Body.Bytes(), &tj)
+			return tj
+		}
+
+		It("should accept a JSON body", func() {
+			w = request("POST", "/api/v1/_multi", "application/json", `{"ids": ["foo", "bar"], "breakdown": true}`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(multiResult().Visits).To(Equal(int64(40)))
+			Expect(multiResult().Objects).To(HaveLen(2))
+		})
+
+		It("should accept repeated ids on GET", func() {
+			w = request("GET", "/api/v1/_multi?id=foo&id=bar", "", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(multiResult().Visits).To(Equal(int64(40)))
+		})
+
+		It("should accept comma separated ids in a form body", func() {
+			w = request("POST", "/api/v1/_multi", "application/x-www-form-urlencoded", "id=foo,bar")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(multiResult().Visits).To(Equal(int64(40)))
+		})
+
+		It("should count ids passed twice once", func() {
+			w = request("GET", "/api/v1/_multi?id=foo,foo&id=bar", "", "")
+			Expect(multiResult().Visits).To(Equal(int64(40)))
+		})
+
+		It("should report validation errors as JSON", func() {
+			w = request("GET", "/api/v1/_multi", "", "")
+			var error ErrorJSON
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(json.Unmarshal(w.Body.Bytes(), &error)).To(Succeed())
+			Expect(error.Error).NotTo(BeEmpty())
+
+			w = request("POST", "/api/v1/_multi", "application/json", `{"ids": "foo"}`)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+		})
+
+		It("should report binding and lookup errors in the same envelope", func() {
+			ENV["SECRET_KEY"] = "sekrit"
+			defer delete(ENV, "SECRET_KEY")
+			var error ErrorJSON
+
+			w = authorizedRequest("POST", "/api/v1/_goals", "sekrit", `{"name": "signup"`)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(json.Unmarshal(w.Body.Bytes(), &error)).To(Succeed())
+			Expect(error.Error).NotTo(BeEmpty())
+
+			w = request("GET", "/api/v1/_goals/nope", "", "")
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+			Expect(json.Unmarshal(w.Body.Bytes(), &error)).To(Succeed())
+			Expect(error.Error).To(Equal("No such goal"))
+		})
 	})
 })
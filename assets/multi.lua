@@ -1,17 +1,34 @@
+-- KEYS are object IDs; ARGV[1] is "1" for a breakdown, and ARGV[2] the prefix
+-- of the site's keys.
+local prefix = ARGV[2] or ""
 local visits = 0
 local uniques = 0
+local migrated_uniques = 0
+local breakdown = {}
 
-for _, key in pairs (KEYS) do
-  local val = redis.pcall("GET", "hits_" .. key)
+local function number(val)
   if val then
-    visits = visits + tonumber(val)
+    return tonumber(val)
+  end
+  return 0
+end
+
+for _, key in pairs (KEYS) do
+  local hits = number(redis.pcall("GET", prefix .. "hits_" .. key)) + number(redis.pcall("GET", prefix .. "visits_" .. key))
+  local migrated = number(redis.pcall("GET", prefix .. "uniques_" .. key))
+  visits = visits + hits
+  migrated_uniques = migrated_uniques + migrated
+  if ARGV[1] == "1" then
+    table.insert(breakdown, key)
+    table.insert(breakdown, hits)
+    table.insert(breakdown, redis.pcall("PFCOUNT", prefix .. "hll_" .. key) + migrated)
   end
 end
 
 local hll_keys = {}
 for _, key in pairs (KEYS) do
-  	table.insert(hll_keys, "hll_" .. key)
+  	table.insert(hll_keys, prefix .. "hll_" .. key)
 end
-uniques = redis.pcall("PFCOUNT", unpack(hll_keys))
+uniques = redis.pcall("PFCOUNT", unpack(hll_keys)) + migrated_uniques
 
-return {visits, uniques}
+return {visits, uniques, breakdown}
@@ -0,0 +1,28 @@
+-- Token bucket. KEYS[1] holds the tokens left and when they were counted.
+-- ARGV: capacity, milliseconds per token, now in milliseconds.
+-- Returns {allowed, milliseconds until the next token}.
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+
+if now > ts then
+  tokens = math.min(capacity, tokens + (now - ts) / interval)
+end
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) * interval)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", math.max(now, ts))
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity * interval))
+
+return {allowed, wait}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiKeyLength = 32
+
+// Each scope grants everything the ones before it do.
+var scopes = []string{"read", "write", "admin"}
+
+type contextKey int
+
+const apiKeyContext contextKey = iota
+
+// APIKey describes a key. The key itself is only shown when it is created;
+// beacon stores a SHA-256 of it.
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+	Key     string    `json:"key,omitempty"`
+}
+
+func (key *APIKey) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&key.Name:  binding.Field{Form: "name", Required: true},
+		&key.Scope: binding.Field{Form: "scope", Required: true},
+	}
+}
+
+func (key *APIKey) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	if scopeRank(key.Scope) < 0 {
+		errs.Add([]string{"scope"}, "ComplexError", "scope must be one of "+strings.Join(scopes, ", "))
+	}
+	return errs
+}
+
+func scopeRank(scope string) int {
+	for i, s := range scopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// Allows reports whether the key grants scope.
+func (key *APIKey) Allows(scope string) bool {
+	return scopeRank(key.Scope) >= scopeRank(scope)
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey mints a new key, returning it with Key set.
+func CreateAPIKey(site *Site, name, scope string) (key APIKey, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	key = APIKey{ID: uniuri.New(), Name: name, Scope: scope, Created: time.Now().UTC()}
+	secret := "bk_" + uniuri.NewLen(apiKeyLength)
+	js, _ := json.Marshal(key)
+	conn.Send("MULTI")
+	conn.Send("HSET", "apikeys", hashAPIKey(secret), js)
+	conn.Send("HSET", "apikey_ids", key.ID, hashAPIKey(secret))
+	if _, err = conn.Do("EXEC"); err != nil {
+		return key, err
+	}
+	key.Key = secret
+	return key, nil
+}
+
+// RevokeAPIKey deletes a key by ID, returning redis.ErrNil if there is none.
+func RevokeAPIKey(site *Site, id string) error {
+	conn := site.Conn()
+	defer conn.Close()
+
+	hash, err := redis.String(conn.Do("HGET", "apikey_ids", id))
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("HDEL", "apikeys", hash)
+	conn.Send("HDEL", "apikey_ids", id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// lookupAPIKey finds the key a request presents as a bearer token. Browsers
+// never send those on their own, unlike cookies and basic auth, so a key can't
+// be borrowed by a cross-site request.
+func lookupAPIKey(req *http.Request) (*APIKey, error) {
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, nil
+	}
+	return findAPIKey(req, strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")))
+}
+
+// findAPIKey looks up a key of the request's site. SECRET_KEY is always an
+// admin key, so the first real keys can be created with it.
+func findAPIKey(req *http.Request, secret string) (*APIKey, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	if master := ENV["SECRET_KEY"]; master != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(master)) == 1 {
+		return &APIKey{ID: "SECRET_KEY", Name: "SECRET_KEY", Scope: "admin"}, nil
+	}
+
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	js, err := redis.Bytes(conn.Do("HGET", "apikeys", hashAPIKey(secret)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key := new(APIKey)
+	return key, json.Unmarshal(js, key)
+}
+
+// requireScope only lets requests through to h if they carry a key with
+// scope: 401 if there is no valid key, 403 if it doesn't allow scope.
+func requireScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key, err := lookupAPIKey(req)
+		if err != nil {
+			fmt.Print(err)
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="beacon"`)
+			jsonError(w, "Must pass a valid API key as an Authorization: Bearer header", http.StatusUnauthorized)
+			return
+		}
+		if !key.Allows(scope) {
+			jsonError(w, "This API key does not have the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		context.Set(req, apiKeyContext, key)
+		h(w, req)
+	}
+}
+
+// requestKeyID identifies the key which authorized a request, for auditing.
+func requestKeyID(req *http.Request) string {
+	if key, ok := context.Get(req, apiKeyContext).(*APIKey); ok {
+		return key.ID
+	}
+	return ""
+}
+
+func apiKeysHandler(w http.ResponseWriter, req *http.Request) {
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("HVALS", "apikeys"))
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys := []APIKey{}
+	for _, value := range values {
+		var key APIKey
+		if err := json.Unmarshal([]byte(value), &key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	js, _ := json.MarshalIndent(keys, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiKeyCreateHandler(w http.ResponseWriter, req *http.Request) {
+	params := new(APIKey)
+	if !bind(w, req, params) {
+		return
+	}
+	key, err := CreateAPIKey(siteFor(req), params.Name, params.Scope)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "create_key", "", key.ID); err != nil {
+		fmt.Print(err)
+	}
+
+	js, _ := json.MarshalIndent(key, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func apiKeyRevokeHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	err := RevokeAPIKey(siteFor(req), id)
+	if err == redis.ErrNil {
+		jsonError(w, "No such API key", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "revoke_key", "", id); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package main_test
+
+import (
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func authorizedRequest(method, url, key, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	Router().ServeHTTP(w, req)
+	return w
+}
+
+var _ = Describe("API keys", func() {
+	var readKey, writeKey, adminKey APIKey
+
+	BeforeEach(func() {
+		readKey, _ = CreateAPIKey(DefaultSite, "dashboard", "read")
+		writeKey, _ = CreateAPIKey(DefaultSite, "importer", "write")
+		adminKey, _ = CreateAPIKey(DefaultSite, "ops", "admin")
+	})
+	AfterEach(resetRedis)
+
+	It("should reject writes without a key", func() {
+		w := request("POST", "/api/v1/foo", "application/json", `{"visits": 10, "uniques": 5}`)
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		Expect(w.Header().Get("WWW-Authenticate")).To(ContainSubstring("Bearer"))
+	})
+
+	It("should reject unknown keys", func() {
+		w := authorizedRequest("POST", "/api/v1/foo", "bk_nope", `{"visits": 10, "uniques": 5}`)
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject keys without the scope", func() {
+		w := authorizedRequest("POST", "/api/v1/foo", readKey.Key, `{"visits": 10, "uniques": 5}`)
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		w = authorizedRequest("DELETE", "/api/v1/foo", writeKey.Key, "")
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should accept keys with the scope or a broader one", func() {
+		w := authorizedRequest("POST", "/api/v1/foo", writeKey.Key, `{"visits": 10, "uniques": 5}`)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		w = authorizedRequest("POST", "/api/v1/foo", adminKey.Key, `{"visits": 10, "uniques": 5}`)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		result, _ := Get(DefaultSite, "foo")
+		Expect(result.Visits).To(Equal(int64(10)))
+	})
+
+	It("should only store hashes of keys", func() {
+		w := authorizedRequest("GET", "/api/v1/_keys", adminKey.Key, "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).NotTo(ContainSubstring(adminKey.Key))
+		var keys []APIKey
+		json.Unmarshal(w.Body.Bytes(), &keys)
+		Expect(keys).To(HaveLen(3))
+	})
+
+	It("should create and revoke keys", func() {
+		w := authorizedRequest("POST", "/api/v1/_keys", adminKey.Key, `{"name": "ci", "scope": "write"}`)
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		var created APIKey
+		json.Unmarshal(w.Body.Bytes(), &created)
+		Expect(created.Key).NotTo(BeEmpty())
+
+		w = authorizedRequest("DELETE", "/api/v1/_keys/"+created.ID, adminKey.Key, "")
+		Expect(w.Code).To(Equal(http.StatusNoContent))
+		w = authorizedRequest("POST", "/api/v1/foo", created.Key, `{"visits": 10, "uniques": 5}`)
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+	})
+})
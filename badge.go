@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultBadgeColor = "#4c1"
+	maxBadgeLabel     = 40
+
+	// Verdana 11px averages about this many pixels a character
+	badgeCharWidth = 7
+	badgePadding   = 10
+)
+
+var (
+	badgeTemplate = template.Must(template.New("badge").Parse(string(mustReadFile("assets/badge.svg"))))
+	badgeColor    = regexp.MustCompile("^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[a-z]+)$")
+	badgeMetrics  = []string{"visits", "uniques"}
+)
+
+// Badge is what assets/badge.svg is rendered from. Label and Value are
+// already escaped.
+type Badge struct {
+	Label, Value, Color                           string
+	Width, LabelWidth, ValueWidth, LabelX, ValueX int
+}
+
+func newBadge(label, value, color string) Badge {
+	badge := Badge{Label: html.EscapeString(label), Value: html.EscapeString(value), Color: color}
+	badge.LabelWidth = utf8.RuneCountInString(label)*badgeCharWidth + badgePadding
+	badge.ValueWidth = utf8.RuneCountInString(value)*badgeCharWidth + badgePadding
+	badge.Width = badge.LabelWidth + badge.ValueWidth
+	badge.LabelX = badge.LabelWidth / 2
+	badge.ValueX = badge.LabelWidth + badge.ValueWidth/2
+	return badge
+}
+
+// humanize abbreviates n like 999, 1.2k, 12k, 3.4M.
+func humanize(n int64) string {
+	units := []string{"", "k", "M", "B", "T"}
+	f := float64(n)
+	i := 0
+	for f >= 999.5 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatInt(n, 10)
+	}
+	precision := 0
+	if f < 9.95 {
+		precision = 1
+	}
+	return strings.TrimSuffix(strconv.FormatFloat(f, 'f', precision, 64), ".0") + units[i]
+}
+
+// badgeHandler renders an object's visits or uniques as an SVG badge. With
+// track=1, showing the badge also counts as a visit, so it is never cached.
+func badgeHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = "visits"
+	}
+	if metric != "visits" && metric != "uniques" {
+		http.Error(w, "metric must be one of "+strings.Join(badgeMetrics, ", "), http.StatusBadRequest)
+		return
+	}
+	label := query.Get("label")
+	if label == "" {
+		label = metric
+	}
+	if utf8.RuneCountInString(label) > maxBadgeLabel {
+		http.Error(w, fmt.Sprintf("label must be at most %d characters", maxBadgeLabel), http.StatusBadRequest)
+		return
+	}
+	color := query.Get("color")
+	if color == "" {
+		color = defaultBadgeColor
+	}
+	if !badgeColor.MatchString(color) {
+		http.Error(w, "color must be a hex color like #4c1, or a color name", http.StatusBadRequest)
+		return
+	}
+	track, _ := strconv.ParseBool(query.Get("track"))
+
+	site := siteFor(req)
+	objectID := mux.Vars(req)["objectID"]
+	if track {
+		event := Event{Site: site, Object: objectID, Time: time.Now()}
+		if !screenHit(w, req, &event) {
+			return
+		}
+		event.User = uid(w, req)
+		events <- event
+	}
+
+	// Shares the cached counts of the read API
+	js, err := cachedJSON(site.prefix()+"object_"+objectID, func() (interface{}, error) {
+		return Get(site, objectID)
+	})
+	var counts TrackJSON
+	if err == nil {
+		err = json.Unmarshal(js, &counts)
+	}
+	if err != nil {
+		fmt.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	value := counts.Visits
+	if metric == "uniques" {
+		value = counts.Uniques
+	}
+
+	var svg bytes.Buffer
+	if err := badgeTemplate.Execute(&svg, newBadge(label, humanize(value), color)); err != nil {
+		fmt.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maxAge := cacheMaxAge()
+	if track {
+		maxAge = 0
+	}
+	writeCacheable(w, req, "image/svg+xml", svg.Bytes(), maxAge)
+}
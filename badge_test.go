@@ -0,0 +1,62 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("Badges", func() {
+	AfterEach(resetRedis)
+
+	It("should show the visits to an object", func() {
+		trackVisit("badged", "jelder")
+		trackVisit("badged", "jelder")
+		w := request("GET", "/badge/badged.svg", "", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Content-Type")).To(Equal("image/svg+xml"))
+		Expect(w.Body.String()).To(ContainSubstring(">visits</text>"))
+		Expect(w.Body.String()).To(ContainSubstring(">2</text>"))
+
+		w = conditionalRequest("/badge/badged.svg", w.Header().Get("ETag"))
+		Expect(w.Code).To(Equal(http.StatusNotModified))
+	})
+
+	It("should abbreviate large counts", func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		conn.Do("SET", "hits_badged", 1234)
+		conn.Do("SET", "hits_other", 56789)
+
+		w := request("GET", "/badge/badged.svg?metric=visits&label=views", "", "")
+		Expect(w.Body.String()).To(ContainSubstring(">views</text>"))
+		Expect(w.Body.String()).To(ContainSubstring(">1.2k</text>"))
+		w = request("GET", "/badge/other.svg", "", "")
+		Expect(w.Body.String()).To(ContainSubstring(">57k</text>"))
+	})
+
+	It("should escape the label", func() {
+		w := request("GET", "/badge/badged.svg?label=<script>", "", "")
+		Expect(w.Body.String()).NotTo(ContainSubstring("<script>"))
+		Expect(w.Body.String()).To(ContainSubstring("&lt;script&gt;"))
+	})
+
+	It("should reject unknown metrics and colors", func() {
+		w := request("GET", "/badge/badged.svg?metric=goals", "", "")
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		w = request("GET", "/badge/badged.svg?color=url(evil)", "", "")
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should count the view with track=1", func() {
+		startTracker.Do(func() { go Tracker() })
+		w := request("GET", "/badge/tracked.svg?track=1", "", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Cache-Control")).To(Equal("public, max-age=0"))
+		Eventually(func() int64 {
+			result, _ := Get(DefaultSite, "tracked")
+			return result.Visits
+		}).Should(Equal(int64(1)))
+	})
+})
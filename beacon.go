@@ -7,14 +7,16 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/mux"
 	"github.com/phyber/negroni-gzip/gzip"
-	"github.com/rs/cors"
 	"net/http"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
 const (
-	cookieMaxAge = 60 * 60 * 60 * 24 * 30
+	cookieMaxAge      = 60 * 60 * 60 * 24 * 30
+	visitorHistoryTTL = 60 * 60 * 24 * 30
 )
 
 var (
@@ -25,28 +27,248 @@ var (
 )
 
 type Event struct {
+	Site   *Site // DefaultSite if nil
 	Object string
 	User   string
+	Depth  int    // Scroll depth milestone; zero for a plain visit
+	Name   string // Custom event, e.g. "signup"; empty for a plain visit
+	Time   time.Time
+
+	// The variant of an A/B experiment this visitor was shown, if any
+	Experiment string
+	Variant    string
+
+	// Host of the page the visitor came from, if any
+	Referrer string
+
+	// Why the hit is only counted as rejected, e.g. "unsigned_hits",
+	// "foreign_hits" or "duplicate_hits"
+	Rejected string
+}
+
+func (event *Event) time() time.Time {
+	if event.Time.IsZero() {
+		return time.Now()
+	}
+	return event.Time
+}
+
+func (event *Event) site() *Site {
+	if event.Site == nil {
+		return DefaultSite
+	}
+	return event.Site
+}
+
+func rejectedKey(objectID string) string {
+	return "rejected_" + objectID
+}
+
+func visitorKey(user string) string {
+	return "visitor_" + user
+}
+
+// visitorState is what has to be known about a hit's visitor before the hit
+// is queued in the MULTI.
+type visitorState struct {
+	history     map[string]string // Objects seen, for goals
+	assignments map[string]string // Experiment variants shown, for goals
+	progress    []int             // Last step reached in each funnel, or -1
+	newVisitor  bool
+}
+
+// readVisitor reads the visitor's state in one round trip, leaving out what
+// none of the site's definitions need.
+func readVisitor(conn redis.Conn, event *Event, defs *definitions) (state visitorState, err error) {
+	visit := event.Depth == 0 && event.Name == ""
+	withGoals := len(defs.goals) > 0
+	withFunnels := visit && len(defs.funnels) > 0
+
+	sent := 0
+	if withGoals {
+		conn.Send("HGETALL", visitorKey(event.User))
+		conn.Send("HGETALL", assignmentsKey(event.User))
+		sent += 2
+	}
+	if withFunnels {
+		keys := make([]interface{}, len(defs.funnels))
+		for i, funnel := range defs.funnels {
+			keys[i] = funnelProgressKey(funnel.Name, event.User)
+		}
+		conn.Send("MGET", keys...)
+		sent++
+	}
+	if visit {
+		claimFirstWeek(conn, event)
+		sent++
+	}
+	if sent == 0 {
+		return state, nil
+	}
+	if err = conn.Flush(); err != nil {
+		return state, err
+	}
+
+	// Every reply is read, even after an error, so none is left to be
+	// mistaken for the reply to a later command
+	replies := make([]interface{}, sent)
+	for i := range replies {
+		var replyErr error
+		if replies[i], replyErr = conn.Receive(); replyErr != nil && err == nil {
+			err = replyErr
+		}
+	}
+	if err != nil {
+		return state, err
+	}
+
+	if withGoals {
+		if state.history, err = stringMap(replies[0], nil); err != nil {
+			return state, err
+		}
+		if state.assignments, err = stringMap(replies[1], nil); err != nil {
+			return state, err
+		}
+		replies = replies[2:]
+	}
+	if withFunnels {
+		steps, err := redis.Values(replies[0], nil)
+		if err != nil {
+			return state, err
+		}
+		for _, value := range steps {
+			step, err := redis.Int(value, nil)
+			if err == redis.ErrNil {
+				step = -1
+			} else if err != nil {
+				return state, err
+			}
+			state.progress = append(state.progress, step)
+		}
+		replies = replies[1:]
+	}
+	if visit {
+		state.newVisitor = replies[0] != nil
+	}
+	return state, nil
 }
 
 func (event *Event) Track(conn redis.Conn) {
+	conn = event.site().wrap(conn)
+	if event.Rejected != "" {
+		trackRejected(conn, event)
+		return
+	}
+
+	var err error
+	if event.Object, err = resolveAlias(conn, event.Object); err != nil {
+		fmt.Print(err)
+	}
+	defs, err := siteDefinitions.get(event.site(), conn)
+	if err != nil {
+		fmt.Print(err)
+		defs = new(definitions)
+	}
+	if event.Depth == 0 && event.Name == "" && len(defs.dedup) > 0 {
+		if duplicate, err := isDuplicateVisit(conn, event, defs.dedup); err != nil {
+			fmt.Print(err)
+		} else if duplicate {
+			event.Rejected = "duplicate_hits"
+			trackRejected(conn, event)
+			return
+		}
+	}
+	visitor, err := readVisitor(conn, event, defs)
+	if err != nil {
+		fmt.Print(err)
+	}
+	goals := completedGoals(event, defs.goals, visitor.history)
+	funnelSteps := reachedFunnelSteps(event, defs.funnels, visitor.progress)
+	groups := rollupGroups(defs.private, event.Object)
+	var assignments map[string]string
+	if len(goals) > 0 {
+		assignments = experimentAssignments(event, visitor.assignments)
+	}
+
 	// http://godoc.org/github.com/garyburd/redigo/redis#hdr-Pipelining
 	conn.Send("MULTI")
 
-	// Track the number of unique visitors in a HyperLogLog
-	// http://redis.io/commands/pfadd
-	conn.Send("PFADD", "hll_"+event.Object, event.User)
+	switch {
+	case event.Depth > 0:
+		trackDepth(conn, event)
+	case event.Name != "":
+		// Custom events only count towards goals
+	default:
+		for _, objectID := range append(groups, event.Object) {
+			// Track the number of unique visitors in a HyperLogLog
+			// http://redis.io/commands/pfadd
+			conn.Send("PFADD", "hll_"+objectID, event.User)
 
-	// Track the total number of visits in a simple key (stringy)
-	// http://redis.io/commands/incr
-	conn.Send("INCR", "hits_"+event.Object)
+			// Track the total number of visits in a simple key (stringy)
+			// http://redis.io/commands/incr
+			conn.Send("INCR", "hits_"+objectID)
 
-	_, err := conn.Do("EXEC")
+			if event.Referrer != "" {
+				conn.Send("ZINCRBY", referralsKey(objectID), 1, event.Referrer)
+			}
+
+			// Let live streams, on any dyno, know the counts have changed
+			conn.Send("PUBLISH", liveChannel(objectID), 1)
+		}
+
+		// Remember when this visitor last saw each object, for goals which
+		// depend on the path taken
+		conn.Send("HSET", visitorKey(event.User), event.Object, event.time().Unix())
+		conn.Send("EXPIRE", visitorKey(event.User), visitorHistoryTTL)
+
+		trackRetention(conn, event, visitor.newVisitor)
+		trackTop(conn, event)
+		trackActive(conn, event)
+	}
+
+	indexObject(conn, event)
+	if event.Experiment != "" {
+		trackExposure(conn, event)
+	}
+	for _, goal := range goals {
+		trackGoal(conn, event, goal)
+		trackConversion(conn, event, goal, assignments)
+	}
+	for _, reached := range funnelSteps {
+		trackFunnelStep(conn, event, reached)
+	}
+
+	_, err = conn.Do("EXEC")
 	if err != nil {
 		fmt.Print(err)
 	}
 }
 
+func trackRejected(conn redis.Conn, event *Event) {
+	if _, err := conn.Do("HINCRBY", rejectedKey(event.Object), event.Rejected, 1); err != nil {
+		fmt.Print(err)
+	}
+}
+
+// ancestors returns the groups an object rolls up into, outermost first.
+func ancestors(objectID string) (groups []string) {
+	separator := hierarchySeparator()
+	if separator == "" {
+		return nil
+	}
+	for i := 0; ; i += len(separator) {
+		next := strings.Index(objectID[i:], separator)
+		if next < 0 {
+			break
+		}
+		i += next
+		if i > 0 {
+			groups = append(groups, objectID[:i])
+		}
+	}
+	return groups
+}
+
 func Tracker() {
 	conn := RedisPool.Get()
 	defer conn.Close()
@@ -63,39 +285,165 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := signCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Println("Beacon running on", fmt.Sprintf("%d", runtime.NumCPU()), "CPUs")
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	go Tracker()
 
+	n := negroni.Classic()
+	compress := gzip.Gzip(gzip.DefaultCompression)
+	n.Use(negroni.HandlerFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		// Events must reach the client as they are written, not when a gzip
+		// block fills up
+		if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+			next(w, req)
+			return
+		}
+		compress.ServeHTTP(w, req, next)
+	}))
+	n.UseHandler(Router())
+	n.Run(listenAddress())
+}
+
+// Router is split out of main so the routes can be exercised without a
+// listener.
+func Router() http.Handler {
+	object := "{objectID:" + objectIDPattern() + "}"
+
 	r := mux.NewRouter()
 	r.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		http.Redirect(w, req, "https://www.github.com/jelder/beacon", 302)
 	})
-	r.HandleFunc("/{objectID}.png", beaconHandler)
-	r.HandleFunc("/api/v1/{objectID}", apiHandler).Methods("GET")
-	r.HandleFunc("/api/v1/_multi", apiMultiHandler).Methods("POST")
-	r.HandleFunc("/api/v1/{objectID}", apiWriteHandler).Methods("POST").Queries("key", ENV["SECRET_KEY"])
+	r.HandleFunc("/"+object+".png", rateLimited("pixel", beaconHandler))
+	r.HandleFunc("/badge/"+object+".svg", rateLimited("pixel", requireReadable(badgeHandler))).Methods("GET")
+	r.HandleFunc("/dashboard", rateLimited("api", requireDashboardKey(dashboardHandler))).Methods("GET")
 
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./assets/")))
+	// Every API route shares the API rate limit
+	api := func(path string, h http.HandlerFunc) *mux.Route {
+		return r.HandleFunc("/api/v1"+path, rateLimited("api", h))
+	}
+	api("/_goals", apiGoalsHandler).Methods("GET")
+	api("/_goals", requireScope("admin", apiGoalWriteHandler)).Methods("POST")
+	api("/_goals/{name}", apiGoalReportHandler).Methods("GET")
+	api("/_goals/{name}", requireScope("admin", apiGoalDeleteHandler)).Methods("DELETE")
+	api("/_funnels", apiFunnelsHandler).Methods("GET")
+	api("/_funnels", requireScope("admin", apiFunnelWriteHandler)).Methods("POST")
+	api("/_funnels/{name}", apiFunnelReportHandler).Methods("GET")
+	api("/_funnels/{name}", requireScope("admin", apiFunnelDeleteHandler)).Methods("DELETE")
+	api("/_experiments/{name}", apiExperimentReportHandler).Methods("GET")
+	api("/_retention", apiRetentionHandler).Methods("GET")
+	api("/_multi", apiMultiHandler).Methods("GET", "POST")
+	api("/_top", apiTopHandler).Methods("GET")
+	api("/_objects", apiObjectsHandler).Methods("GET")
+	api("/_active", apiActiveHandler).Methods("GET")
+	api("/_audit", requireScope("admin", apiAuditHandler)).Methods("GET")
+	api("/_keys", requireScope("admin", apiKeysHandler)).Methods("GET")
+	api("/_keys", requireScope("admin", apiKeyCreateHandler)).Methods("POST")
+	api("/_keys/{id}", requireScope("admin", apiKeyRevokeHandler)).Methods("DELETE")
+	api("/_private", requireScope("admin", apiPrivateHandler)).Methods("GET")
+	api("/_private", requireScope("admin", apiPrivateWriteHandler)).Methods("POST")
+	api("/_private", requireScope("admin", apiPrivateDeleteHandler)).Methods("DELETE")
+	api("/_share", requireScope("read", apiShareHandler)).Methods("POST")
+	api("/_sign", requireScope("write", apiSignHandler)).Methods("POST")
+	api("/_dedup", requireScope("admin", apiDedupHandler)).Methods("GET")
+	api("/_dedup", requireScope("admin", apiDedupWriteHandler)).Methods("POST")
+	api("/_dedup", requireScope("admin", apiDedupDeleteHandler)).Methods("DELETE")
+	api("/_referers", requireScope("admin", apiReferersHandler)).Methods("GET")
+	api("/_referers", requireScope("admin", apiRefererWriteHandler)).Methods("POST")
+	api("/_referers", requireScope("admin", apiRefererDeleteHandler)).Methods("DELETE")
+	api("/_sites", requireDefaultSite(requireScope("admin", apiSitesHandler))).Methods("GET")
+	api("/_sites", requireDefaultSite(requireScope("admin", apiSiteWriteHandler))).Methods("POST")
+	api("/_sites/{name}", requireDefaultSite(requireScope("admin", apiSiteDeleteHandler))).Methods("DELETE")
+	api("/"+object+"/depth", requireReadable(apiDepthHandler)).Methods("GET")
+	api("/"+object+"/live", requireReadable(apiLiveHandler)).Methods("GET")
+	api("/"+object+"/referrers", requireReadable(apiReferrersHandler)).Methods("GET")
+	api("/"+object+"/rejected", requireReadable(apiRejectedHandler)).Methods("GET")
+	api("/"+object+"/series", requireReadable(apiSeriesHandler)).Methods("GET")
+	api("/"+object+"/reset", requireScope("admin", apiResetHandler)).Methods("POST")
+	api("/"+object+"/merge", requireScope("admin", apiMergeHandler)).Methods("POST")
+	api("/"+object, requireReadable(apiHandler)).Methods("GET")
+	api("/"+object, requireScope("write", apiWriteHandler)).Methods("POST")
+	api("/"+object, requireScope("admin", apiDeleteHandler)).Methods("DELETE")
 
-	n := negroni.Classic()
-	n.Use(gzip.Gzip(gzip.DefaultCompression))
-	n.Use(cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-	}))
-	n.UseHandler(r)
-	n.Run(listenAddress())
+	// Cache hit ratios and the other expvars
+	r.Handle("/debug/vars", requireDefaultSite(requireScope("admin", http.DefaultServeMux.ServeHTTP)))
+
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./assets/")))
+	return siteHandler(r)
 }
 
 func beaconHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	objectID := vars["objectID"]
-	events <- Event{objectID, uid(w, req)}
+	query := req.URL.Query()
+	event := Event{
+		Site:       siteFor(req),
+		Object:     vars["objectID"],
+		Name:       query.Get("event"),
+		Time:       time.Now(),
+		Experiment: query.Get("experiment"),
+		Variant:    query.Get("variant"),
+		Referrer:   referrer(req),
+	}
+	if !screenHit(w, req, &event) {
+		return
+	}
+	if (event.Experiment == "") != (event.Variant == "") {
+		http.Error(w, "experiment and variant must be passed together", http.StatusBadRequest)
+		return
+	}
+	if event.Experiment != "" && !(experimentName.MatchString(event.Experiment) && experimentName.MatchString(event.Variant)) {
+		http.Error(w, "experiment and variant must be at most 64 letters, digits, dots, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+	if depth := query.Get("depth"); depth != "" {
+		var err error
+		if event.Depth, err = parseDepth(depth); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	event.User = uid(w, req)
+	events <- event
 	w.Header().Set("Content-Type", "image/png")
 	w.Write(beaconPng)
 }
 
+// screenHit checks a hit's signature and referer, marking it as rejected if
+// it fails either. It returns false if the hit was refused outright, having
+// replied to it.
+func screenHit(w http.ResponseWriter, req *http.Request, event *Event) bool {
+	if mode := pixelSigning(); mode != "" && !validToken("pixel", event.site().prefix()+event.Object, req.URL.Query().Get("sig"), event.Time) {
+		if mode == "require" {
+			http.Error(w, "This tracking image must be signed", http.StatusForbidden)
+			return false
+		}
+		event.Rejected = "unsigned_hits"
+	}
+	// Only the first reason a hit is rejected for is counted, so the referer
+	// only matters for one already rejected if it could be refused outright
+	if event.Rejected != "" && foreignHits() != "reject" {
+		return true
+	}
+	if foreign, err := isForeignHit(req); err != nil {
+		fmt.Print(err)
+	} else if foreign {
+		if foreignHits() == "reject" {
+			http.Error(w, "This tracking image can't be embedded here", http.StatusForbidden)
+			return false
+		}
+		event.Rejected = "foreign_hits"
+	}
+	return true
+}
+
 func uid(w http.ResponseWriter, req *http.Request) string {
 	cookie, err := req.Cookie("uid")
 	if err != nil {
@@ -103,7 +451,9 @@ func uid(w http.ResponseWriter, req *http.Request) string {
 		case http.ErrNoCookie:
 			uid := fmt.Sprintf("%s", uniuri.New())
 			now := time.Now()
-			newCookie := &http.Cookie{Name: "uid", Value: uid, MaxAge: cookieMaxAge, Expires: now.Add(cookieMaxAge)}
+			site := siteFor(req)
+			maxAge := site.cookieMaxAge()
+			newCookie := &http.Cookie{Name: "uid", Value: uid, Domain: site.CookieDomain, MaxAge: maxAge, Expires: now.Add(time.Duration(maxAge) * time.Second)}
 			fmt.Print("Setting new cookie ", newCookie)
 			http.SetCookie(w, newCookie)
 			return uid
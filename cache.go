@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Beyond this many entries, expired ones are swept before adding another. If
+// none have expired, a tenth of the cache is evicted at random, so clients
+// asking for many different things can't grow it, or make every insert sweep.
+const maxCacheEntries = 10000
+
+var (
+	cacheStats = expvar.NewMap("read_cache")
+	readCache  = &responseCache{entries: map[string]cacheEntry{}}
+)
+
+func init() {
+	// Seeded so the ratio can be read before the first lookup, or with the
+	// cache off
+	cacheStats.Add("hits", 0)
+	cacheStats.Add("misses", 0)
+	cacheStats.Set("hit_ratio", expvar.Func(cacheHitRatio))
+}
+
+func cacheHitRatio() interface{} {
+	hits, _ := strconv.ParseFloat(cacheStats.Get("hits").String(), 64)
+	misses, _ := strconv.ParseFloat(cacheStats.Get("misses").String(), 64)
+	if hits+misses == 0 {
+		return 0.0
+	}
+	return hits / (hits + misses)
+}
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// responseCache holds rendered read API responses for READ_CACHE_TTL, so
+// polling dashboards don't each reach Redis.
+type responseCache struct {
+	sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func (c *responseCache) get(key string, now time.Time) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *responseCache) set(key string, body []byte, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Map iteration order is unspecified, which is random enough
+		for k := range c.entries {
+			if len(c.entries) < maxCacheEntries-maxCacheEntries/10 {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{body, expires}
+}
+
+// cachedJSON returns the JSON rendering of what load returns, from the cache
+// if it is still fresh there.
+func cachedJSON(key string, load func() (interface{}, error)) ([]byte, error) {
+	ttl := readCacheTTL()
+	now := time.Now()
+	if ttl > 0 {
+		if js, ok := readCache.get(key, now); ok {
+			cacheStats.Add("hits", 1)
+			return js, nil
+		}
+		cacheStats.Add("misses", 1)
+	}
+
+	response, err := load()
+	if err != nil {
+		return nil, err
+	}
+	js, _ := json.MarshalIndent(response, "", "  ")
+	if ttl > 0 {
+		readCache.set(key, js, now.Add(ttl))
+	}
+	return js, nil
+}
+
+func etag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:10]) + `"`
+}
+
+// writeCacheableJSON writes a read API response with an ETag and
+// Cache-Control, or a 304 if the client already has it.
+func writeCacheableJSON(w http.ResponseWriter, req *http.Request, js []byte) {
+	writeCacheable(w, req, "application/json", js, cacheMaxAge())
+}
+
+// writeCacheable lets clients keep body for maxAge seconds, then revalidate
+// it by its ETag. Responses which may be private are only cached by the
+// client.
+func writeCacheable(w http.ResponseWriter, req *http.Request, contentType string, body []byte, maxAge int) {
+	tag := etag(body)
+	visibility := "public"
+	if req.Header.Get("Authorization") != "" || req.URL.Query().Get("token") != "" {
+		visibility = "private"
+	}
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Cache-Control", visibility+", max-age="+strconv.Itoa(maxAge))
+
+	for _, match := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == tag || match == "W/"+tag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
@@ -0,0 +1,94 @@
+package main_test
+
+import (
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+func conditionalRequest(url, etag string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+	Router().ServeHTTP(w, req)
+	return w
+}
+
+func trackVisit(objectID, user string) {
+	conn := RedisPool.Get()
+	defer conn.Close()
+	event := Event{Object: objectID, User: user}
+	event.Track(conn)
+}
+
+var _ = Describe("Read caching", func() {
+	AfterEach(resetRedis)
+
+	It("should answer a matching ETag with 304", func() {
+		trackVisit("etagged", "jelder")
+		w := request("GET", "/api/v1/etagged", "", "")
+		etag := w.Header().Get("ETag")
+		Expect(etag).NotTo(BeEmpty())
+		Expect(w.Header().Get("Cache-Control")).To(Equal("public, max-age=0"))
+
+		w = conditionalRequest("/api/v1/etagged", etag)
+		Expect(w.Code).To(Equal(http.StatusNotModified))
+		Expect(w.Body.Len()).To(Equal(0))
+
+		trackVisit("etagged", "jelder")
+		w = conditionalRequest("/api/v1/etagged", etag)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("ETag")).NotTo(Equal(etag))
+	})
+
+	It("should use the configured max-age", func() {
+		ENV["CACHE_MAX_AGE"] = "30"
+		defer delete(ENV, "CACHE_MAX_AGE")
+		w := request("GET", "/api/v1/_multi?id=etagged", "", "")
+		Expect(w.Header().Get("Cache-Control")).To(Equal("public, max-age=30"))
+	})
+
+	It("should report the hit ratio with the cache off", func() {
+		ENV["SECRET_KEY"] = "sekrit"
+		defer delete(ENV, "SECRET_KEY")
+		request("GET", "/api/v1/uncached", "", "")
+
+		var vars struct {
+			Cache struct {
+				HitRatio float64 `json:"hit_ratio"`
+			} `json:"read_cache"`
+		}
+		w := authorizedRequest("GET", "/debug/vars", "sekrit", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(w.Body.Bytes(), &vars)).To(Succeed())
+	})
+
+	It("should reuse responses within READ_CACHE_TTL and count hits", func() {
+		ENV["READ_CACHE_TTL"] = "60"
+		ENV["SECRET_KEY"] = "sekrit"
+		defer delete(ENV, "READ_CACHE_TTL")
+		defer delete(ENV, "SECRET_KEY")
+
+		var result TrackJSON
+		trackVisit("cached", "jelder")
+		request("GET", "/api/v1/cached", "", "")
+		trackVisit("cached", "jelder")
+		w := request("GET", "/api/v1/cached", "", "")
+		json.Unmarshal(w.Body.Bytes(), &result)
+		Expect(result.Visits).To(Equal(int64(1)))
+
+		var vars struct {
+			Cache struct {
+				Hits     int64   `json:"hits"`
+				HitRatio float64 `json:"hit_ratio"`
+			} `json:"read_cache"`
+		}
+		w = authorizedRequest("GET", "/debug/vars", "sekrit", "")
+		json.Unmarshal(w.Body.Bytes(), &vars)
+		Expect(vars.Cache.Hits).To(BeNumerically(">=", 1))
+		Expect(vars.Cache.HitRatio).To(BeNumerically(">", 0))
+	})
+})
@@ -5,6 +5,9 @@ import (
 	"github.com/garyburd/redigo/redis"
 	. "github.com/jelder/env"
 	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,6 +21,156 @@ func listenAddress() string {
 	return ":" + ENV.Get("PORT", "8080")
 }
 
+// HIERARCHY_SEPARATOR splits object IDs like blog/2024/post_1234 into the
+// groups (blog, blog/2024) which each hit also rolls up into.
+func hierarchySeparator() string {
+	return ENV["HIERARCHY_SEPARATOR"]
+}
+
+// objectIDPattern lets object IDs span path segments when they are separated
+// by slashes.
+func objectIDPattern() string {
+	if strings.Contains(hierarchySeparator(), "/") {
+		return ".+"
+	}
+	return "[^/]+"
+}
+
+// PIXEL_SIGNING=count records hits on tracking images without a valid sig
+// separately as unsigned_hits; PIXEL_SIGNING=require rejects them outright.
+func pixelSigning() string {
+	switch mode := ENV["PIXEL_SIGNING"]; mode {
+	case "count", "require":
+		return mode
+	}
+	return ""
+}
+
+// signingKey is the HMAC key for tokens of purpose; signing is unavailable
+// without one. Signed pixel URLs are handed out to anyone, so they get their
+// own PIXEL_SIGNING_KEY rather than the admin SECRET_KEY.
+func signingKey(purpose string) string {
+	if purpose == "pixel" {
+		return ENV["PIXEL_SIGNING_KEY"]
+	}
+	return ENV["SECRET_KEY"]
+}
+
+// PIXEL_RATE_LIMIT and API_RATE_LIMIT are "<requests>/<seconds>", e.g.
+// "120/60". A client may burst up to requests at once, then regains one every
+// seconds/requests. Unset or malformed limits disable rate limiting.
+func rateLimitConfig(group string) (requests int64, per time.Duration, ok bool) {
+	parts := strings.SplitN(ENV[strings.ToUpper(group)+"_RATE_LIMIT"], "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	requests, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || requests <= 0 {
+		return 0, 0, false
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, 0, false
+	}
+	return requests, time.Duration(seconds) * time.Second, true
+}
+
+// RATE_LIMIT_BY picks what a client is: its ip (the default), its uid cookie,
+// or both, in which case each gets its own bucket.
+func rateLimitBy() string {
+	switch by := ENV["RATE_LIMIT_BY"]; by {
+	case "uid", "both":
+		return by
+	}
+	return "ip"
+}
+
+// CORS_<GROUP>_ORIGINS lists, comma separated, the origins allowed to make
+// cross-origin requests to the read, write or pixel routes of sites which
+// don't set their own. CORS_<GROUP>_CREDENTIALS=true lets them send cookies
+// and API keys.
+func corsDefaults(group string) (origins []string, credentials bool) {
+	name := "CORS_" + strings.ToUpper(group)
+	for _, origin := range strings.Split(ENV[name+"_ORIGINS"], ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins, ENV[name+"_CREDENTIALS"] == "true"
+}
+
+// FOREIGN_HITS=reject refuses hits on tracking images embedded on domains
+// outside a site's referer allow-list; by default they are counted separately
+// as foreign_hits.
+func foreignHits() string {
+	if ENV["FOREIGN_HITS"] == "reject" {
+		return "reject"
+	}
+	return "count"
+}
+
+// ALLOW_MISSING_REFERER=true accepts hits which don't say what page they are
+// from on sites with a referer allow-list. Otherwise they are foreign, since
+// leaving the header out is the easiest way around the list.
+func allowMissingReferer() bool {
+	allow, _ := strconv.ParseBool(ENV["ALLOW_MISSING_REFERER"])
+	return allow
+}
+
+// READ_CACHE_TTL is how many seconds read API responses are reused for;
+// zero, the default, turns the cache off. CACHE_MAX_AGE is how many seconds
+// clients may do the same without revalidating their ETag.
+func readCacheTTL() time.Duration {
+	seconds, _ := strconv.Atoi(ENV["READ_CACHE_TTL"])
+	return time.Duration(seconds) * time.Second
+}
+
+func cacheMaxAge() int {
+	seconds, err := strconv.Atoi(ENV["CACHE_MAX_AGE"])
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+// LIVE_INTERVAL is the least number of seconds between updates on a live
+// stream, 1 by default. LIVE_MAX_CONNECTIONS caps the streams each process
+// serves at once, 1000 by default.
+func liveInterval() time.Duration {
+	seconds, err := strconv.Atoi(ENV["LIVE_INTERVAL"])
+	if err != nil || seconds < 0 {
+		seconds = 1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func liveMaxConnections() int64 {
+	max, err := strconv.ParseInt(ENV["LIVE_MAX_CONNECTIONS"], 10, 64)
+	if err != nil || max < 0 {
+		return 1000
+	}
+	return max
+}
+
+// ACTIVE_WINDOW is how many seconds after their last hit a visitor still
+// counts as active, 300 by default. ACTIVE_INTERVAL is how often, in seconds,
+// active counts are pushed to WebSocket clients, 5 by default.
+func activeWindow() time.Duration {
+	seconds, err := strconv.Atoi(ENV["ACTIVE_WINDOW"])
+	if err != nil || seconds <= 0 {
+		seconds = 300
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func activeInterval() time.Duration {
+	seconds, err := strconv.Atoi(ENV["ACTIVE_INTERVAL"])
+	if err != nil || seconds <= 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func redisConfig() (string, string) {
 	redisProvider := ENV["REDIS_PROVIDER"]
 	if redisProvider == "" {
@@ -39,7 +192,8 @@ func redisConfig() (string, string) {
 }
 
 func redisSetup(server, password string) *redis.Pool {
-	fmt.Println("Connecting to Redis on", server, password)
+	// Not on stdout, which `beacon sign` prints its URL to
+	fmt.Fprintln(os.Stderr, "Connecting to Redis on", server)
 	return &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/rs/cors"
+	"net/http"
+	"strings"
+)
+
+// Each route group has its own cross-origin policy: "read" for the read API,
+// "write" for the rest of the API, and "pixel" for tracking images and the
+// other assets.
+var routeGroups = []string{"read", "write", "pixel"}
+
+// A CORSPolicy lets Origins make cross-origin requests to a route group.
+type CORSPolicy struct {
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods,omitempty"`
+	Credentials bool     `json:"credentials,omitempty"`
+}
+
+func isRouteGroup(group string) bool {
+	for _, g := range routeGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func allowsAnyOrigin(origins []string) bool {
+	for _, origin := range origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// routeGroup classifies a request, or the request a preflight is asking
+// about. POSTs to _multi are reads, since they are only a way to pass many
+// ids.
+func routeGroup(req *http.Request) string {
+	method := req.Method
+	if requested := req.Header.Get("Access-Control-Request-Method"); method == "OPTIONS" && requested != "" {
+		method = requested
+	}
+	switch path := req.URL.Path; {
+	case !strings.HasPrefix(path, "/api/"):
+		return "pixel"
+	case method == "GET" || method == "HEAD" || path == "/api/v1/_multi":
+		return "read"
+	}
+	return "write"
+}
+
+// corsPolicy is the site's policy for group. Without one of its own, the
+// site's Origins apply to reads and pixels, then the CORS_* defaults. Reads
+// and pixels are open to any origin unless configured otherwise; writes are
+// closed.
+func (site *Site) corsPolicy(group string) CORSPolicy {
+	if policy, ok := site.CORS[group]; ok {
+		return policy
+	}
+	var policy CORSPolicy
+	policy.Origins, policy.Credentials = corsDefaults(group)
+	if group != "write" && len(site.Origins) > 0 {
+		policy.Origins = site.Origins
+	}
+	if group != "write" && len(policy.Origins) == 0 {
+		policy.Origins = []string{"*"}
+	}
+	return policy
+}
+
+// cors returns a handler for the site's policy for group, or nil if it
+// allows no origins.
+func (site *Site) cors(group string) *cors.Cors {
+	policy := site.corsPolicy(group)
+	if len(policy.Origins) == 0 {
+		return nil
+	}
+	methods := policy.Methods
+	if len(methods) == 0 {
+		switch group {
+		case "read":
+			methods = []string{"GET", "HEAD", "POST"}
+		case "write":
+			methods = []string{"POST", "DELETE"}
+		default:
+			methods = []string{"GET", "HEAD"}
+		}
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins: policy.Origins,
+		AllowedMethods: methods,
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		// Echoing any origin with credentials would let every page use a
+		// visitor's cookies
+		AllowCredentials: policy.Credentials && !allowsAnyOrigin(policy.Origins),
+	})
+}
@@ -0,0 +1,86 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+func crossOriginRequest(method, url, origin, preflight string) http.Header {
+	return crossOriginRequestTo(Router(), method, url, origin, preflight)
+}
+
+func crossOriginRequestTo(router http.Handler, method, url, origin, preflight string) http.Header {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Origin", origin)
+	if preflight != "" {
+		req.Header.Set("Access-Control-Request-Method", preflight)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Header()
+}
+
+var _ = Describe("CORS", func() {
+	BeforeEach(func() {
+		SaveSite(Site{
+			Name:    "acme",
+			Origins: []string{"https://www.acme.com"},
+			CORS: map[string]CORSPolicy{
+				"write": {Origins: []string{"https://admin.acme.com"}, Credentials: true},
+			},
+		})
+	})
+	AfterEach(resetRedis)
+
+	It("should let any origin read the default site", func() {
+		headers := crossOriginRequest("GET", "/api/v1/foo", "https://example.com", "")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://example.com"))
+		headers = crossOriginRequest("OPTIONS", "/api/v1/_multi", "https://example.com", "POST")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://example.com"))
+	})
+
+	It("should not open writes to other origins by default", func() {
+		headers := crossOriginRequest("OPTIONS", "/api/v1/foo", "https://example.com", "POST")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+
+	It("should apply a site's own policies", func() {
+		headers := crossOriginRequest("GET", "/s/acme/api/v1/foo", "https://example.com", "")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+		headers = crossOriginRequest("GET", "/s/acme/api/v1/foo", "https://www.acme.com", "")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://www.acme.com"))
+
+		headers = crossOriginRequest("OPTIONS", "/s/acme/api/v1/foo", "https://www.acme.com", "POST")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+		headers = crossOriginRequest("OPTIONS", "/s/acme/api/v1/foo", "https://admin.acme.com", "POST")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://admin.acme.com"))
+		Expect(headers.Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+	})
+
+	It("should not carry one request's policy over to the next", func() {
+		router := Router()
+		for i := 0; i < 3; i++ {
+			headers := crossOriginRequestTo(router, "OPTIONS", "/s/acme/api/v1/foo", "https://admin.acme.com", "POST")
+			Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://admin.acme.com"))
+			headers = crossOriginRequestTo(router, "OPTIONS", "/api/v1/foo", "https://admin.acme.com", "POST")
+			Expect(headers.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			headers = crossOriginRequestTo(router, "GET", "/s/acme/api/v1/foo", "https://example.com", "")
+			Expect(headers.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			headers = crossOriginRequestTo(router, "GET", "/api/v1/foo", "https://example.com", "")
+			Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://example.com"))
+			Expect(headers["Vary"]).To(HaveLen(1))
+		}
+	})
+
+	It("should take the default site's policies from the environment", func() {
+		ENV["CORS_READ_ORIGINS"] = "https://www.example.com, https://blog.example.com"
+		defer delete(ENV, "CORS_READ_ORIGINS")
+		headers := crossOriginRequest("GET", "/api/v1/foo", "https://evil.com", "")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+		headers = crossOriginRequest("GET", "/api/v1/foo", "https://blog.example.com", "")
+		Expect(headers.Get("Access-Control-Allow-Origin")).To(Equal("https://blog.example.com"))
+	})
+})
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardPage))
+
+// requireDashboardKey asks browsers for a read key with basic auth; any user
+// name will do. Basic auth is only accepted here: the page hands the key to
+// its scripts, which pass it to the API as a bearer token.
+func requireDashboardKey(h func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, secret, _ := req.BasicAuth()
+		key, err := findAPIKey(req, secret)
+		if err != nil {
+			fmt.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if key == nil || !key.Allows("read") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="beacon"`)
+			http.Error(w, "Sign in with an API key as the password", http.StatusUnauthorized)
+			return
+		}
+		h(w, req, secret)
+	}
+}
+
+func dashboardHandler(w http.ResponseWriter, req *http.Request, secret string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := dashboardTemplate.Execute(w, struct{ Key string }{secret}); err != nil {
+		fmt.Print(err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+// dashboardPage is the dashboard, a template for html/template. It is kept in
+// the binary rather than assets/, which is served to anyone.
+const dashboardPage = `<!doctype html>
+<html lang=en-us>
+<head>
+  <meta charset=utf-8>
+  <meta name=viewport content="width=device-width, initial-scale=1">
+  <title>Beacon Dashboard</title>
+  <style>
+    body { margin: 0; font: 14px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; background: #f5f6f8; }
+    header { display: flex; align-items: center; gap: 16px; padding: 12px 24px; background: #24292e; color: #fff; }
+    header h1 { margin: 0; font-size: 18px; }
+    header form { margin-left: auto; display: flex; gap: 8px; }
+    input, select, button { font: inherit; padding: 4px 8px; border: 1px solid #ccc; border-radius: 3px; }
+    main { max-width: 1100px; margin: 0 auto; padding: 16px 24px; }
+    section { background: #fff; border: 1px solid #e1e4e8; border-radius: 4px; padding: 16px; margin-bottom: 16px; }
+    h2 { margin: 0 0 12px; font-size: 16px; }
+    h3 { margin: 16px 0 8px; font-size: 14px; color: #586069; }
+    .cards { display: flex; gap: 16px; flex-wrap: wrap; }
+    .card { flex: 1; min-width: 140px; padding: 12px; background: #f6f8fa; border-radius: 4px; }
+    .card b { display: block; font-size: 24px; }
+    .card span { color: #586069; }
+    .columns { display: flex; gap: 16px; flex-wrap: wrap; }
+    .columns > div { flex: 1; min-width: 300px; }
+    table { width: 100%; border-collapse: collapse; }
+    th, td { padding: 4px 8px; text-align: left; border-bottom: 1px solid #eee; }
+    td.n, th.n { text-align: right; font-variant-numeric: tabular-nums; }
+    td.bar { width: 35%; }
+    td.bar div { height: 8px; background: #0366d6; border-radius: 2px; }
+    a { color: #0366d6; cursor: pointer; text-decoration: none; }
+    svg rect.visits { fill: #0366d6; }
+    svg rect.visits:hover { fill: #044289; }
+    svg polyline { fill: none; stroke: #f66a0a; stroke-width: 2; }
+    svg text { font-size: 10px; fill: #586069; }
+    .error { color: #cb2431; }
+    .empty { color: #959da5; }
+    .hidden { display: none; }
+  </style>
+</head>
+<body>
+<header>
+  <h1>Beacon</h1>
+  <select id="period">
+    <option value="day">Today</option>
+    <option value="week">This week</option>
+    <option value="month">This month</option>
+  </select>
+  <form id="search">
+    <input id="object" list="objects" placeholder="Object ID, e.g. post_1234" size="30">
+    <datalist id="objects"></datalist>
+    <button>Show</button>
+  </form>
+</header>
+<main>
+  <p id="error" class="error hidden"></p>
+
+  <section>
+    <h2>Overview</h2>
+    <div class="cards">
+      <div class="card"><b id="overview-objects">–</b><span>objects visited</span></div>
+      <div class="card"><b id="overview-visits">–</b><span>visits</span></div>
+      <div class="card"><b id="overview-uniques">–</b><span>uniques, summed per object</span></div>
+    </div>
+    <h3>Top objects</h3>
+    <table>
+      <thead><tr><th>Object</th><th></th><th class="n">Visits</th><th class="n">Uniques</th></tr></thead>
+      <tbody id="top"></tbody>
+    </table>
+  </section>
+
+  <section id="detail" class="hidden">
+    <h2 id="detail-title"></h2>
+    <div class="cards">
+      <div class="card"><b id="detail-visits">–</b><span>visits, all time</span></div>
+      <div class="card"><b id="detail-uniques">–</b><span>uniques, all time</span></div>
+      <div class="card"><b id="detail-recent">–</b><span>visits, last 30 days</span></div>
+    </div>
+    <h3>Last 30 days <small>(bars are visits, the line is uniques)</small></h3>
+    <svg id="chart" width="100%" height="180" preserveAspectRatio="none"></svg>
+    <div class="columns">
+      <div>
+        <h3>Referrers</h3>
+        <table>
+          <thead><tr><th>Host</th><th></th><th class="n">Visits</th></tr></thead>
+          <tbody id="referrers"></tbody>
+        </table>
+      </div>
+      <div>
+        <h3>Breakdown</h3>
+        <table>
+          <thead><tr><th>Object</th><th></th><th class="n">Visits</th><th class="n">Uniques</th></tr></thead>
+          <tbody id="breakdown"></tbody>
+        </table>
+      </div>
+    </div>
+  </section>
+</main>
+<script>
+// The API is relative to this page, so a site's dashboard under /s/<name>/
+// reads that site's stats, with the key the page was opened with.
+var api = 'api/v1/';
+var key = {{.Key}};
+
+function get(path) {
+  return fetch(api + path, { headers: { Authorization: 'Bearer ' + key } }).then(function (response) {
+    return response.json().then(function (body) {
+      if (!response.ok) {
+        throw new Error(body.error || response.statusText);
+      }
+      return body;
+    });
+  });
+}
+
+function showError(err) {
+  var p = document.getElementById('error');
+  p.textContent = err.message;
+  p.classList.remove('hidden');
+}
+
+function number(n) {
+  return n.toLocaleString();
+}
+
+function cell(row, text, className) {
+  var td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function bar(row, value, max) {
+  var div = document.createElement('div');
+  div.style.width = (max ? 100 * value / max : 0) + '%';
+  cell(row, '', 'bar').appendChild(div);
+}
+
+function objectLink(row, id) {
+  var a = document.createElement('a');
+  a.textContent = id;
+  a.href = '#' + encodeURIComponent(id);
+  row.insertCell().appendChild(a);
+}
+
+function fill(tbody, rows, render) {
+  tbody.textContent = '';
+  if (rows.length === 0) {
+    cell(tbody.insertRow(), 'Nothing yet', 'empty').colSpan = 4;
+  }
+  rows.forEach(function (row) {
+    render(tbody.insertRow(), row);
+  });
+}
+
+function loadOverview() {
+  var period = document.getElementById('period').value;
+  get('_top?limit=100&period=' + period).then(function (top) {
+    var visits = 0, uniques = 0, max = 0;
+    top.objects.forEach(function (object) {
+      visits += object.visits;
+      uniques += object.uniques;
+      max = Math.max(max, object.visits);
+    });
+    document.getElementById('overview-objects').textContent = number(top.objects.length) + (top.objects.length === 100 ? '+' : '');
+    document.getElementById('overview-visits').textContent = number(visits);
+    document.getElementById('overview-uniques').textContent = number(uniques);
+    fill(document.getElementById('top'), top.objects.slice(0, 20), function (row, object) {
+      objectLink(row, object.id);
+      bar(row, object.visits, max);
+      cell(row, number(object.visits), 'n');
+      cell(row, number(object.uniques), 'n');
+    });
+  }).catch(showError);
+}
+
+function chart(days) {
+  var svg = document.getElementById('chart');
+  var ns = 'http://www.w3.org/2000/svg';
+  var width = 600, height = 160, step = width / days.length;
+  var max = Math.max.apply(null, days.map(function (d) { return d.visits; }).concat([1]));
+  var points = [];
+  svg.setAttribute('viewBox', '0 0 ' + width + ' ' + (height + 20));
+  svg.textContent = '';
+  days.forEach(function (d, i) {
+    var rect = document.createElementNS(ns, 'rect');
+    var h = height * d.visits / max;
+    rect.setAttribute('class', 'visits');
+    rect.setAttribute('x', i * step + 1);
+    rect.setAttribute('y', height - h);
+    rect.setAttribute('width', step - 2);
+    rect.setAttribute('height', h);
+    var title = document.createElementNS(ns, 'title');
+    title.textContent = d.date + ': ' + number(d.visits) + ' visits, ' + number(d.uniques) + ' uniques';
+    rect.appendChild(title);
+    svg.appendChild(rect);
+    points.push((i + 0.5) * step + ',' + (height - height * d.uniques / max));
+    if (i % 7 === 0) {
+      var label = document.createElementNS(ns, 'text');
+      label.setAttribute('x', i * step + 1);
+      label.setAttribute('y', height + 14);
+      label.textContent = d.date.slice(5);
+      svg.appendChild(label);
+    }
+  });
+  var line = document.createElementNS(ns, 'polyline');
+  line.setAttribute('points', points.join(' '));
+  svg.appendChild(line);
+}
+
+function loadObject(id) {
+  var object = encodeURIComponent(id);
+  document.getElementById('detail').classList.remove('hidden');
+  document.getElementById('detail-title').textContent = id;
+  document.getElementById('object').value = id;
+
+  get(object).then(function (totals) {
+    document.getElementById('detail-visits').textContent = number(totals.visits);
+    document.getElementById('detail-uniques').textContent = number(totals.uniques);
+  }).catch(showError);
+
+  get(object + '/series').then(function (series) {
+    document.getElementById('detail-recent').textContent = number(series.visits);
+    chart(series.days);
+  }).catch(showError);
+
+  get(object + '/referrers').then(function (response) {
+    var max = response.referrers.length ? response.referrers[0].visits : 0;
+    fill(document.getElementById('referrers'), response.referrers, function (row, referrer) {
+      cell(row, referrer.host);
+      bar(row, referrer.visits, max);
+      cell(row, number(referrer.visits), 'n');
+    });
+  }).catch(showError);
+
+  // Objects nested under this one, by ID
+  get('_objects?limit=50&prefix=' + object).then(function (response) {
+    var ids = response.objects.map(function (o) { return o.id; }).filter(function (o) { return o !== id; });
+    if (ids.length === 0) {
+      return { objects: {} };
+    }
+    return get('_multi?breakdown=true&id=' + ids.map(encodeURIComponent).join(','));
+  }).then(function (multi) {
+    var rows = Object.keys(multi.objects || {}).map(function (o) {
+      return { id: o, visits: multi.objects[o].visits, uniques: multi.objects[o].uniques };
+    }).sort(function (a, b) { return b.visits - a.visits; });
+    var max = rows.length ? rows[0].visits : 0;
+    fill(document.getElementById('breakdown'), rows, function (row, child) {
+      objectLink(row, child.id);
+      bar(row, child.visits, max);
+      cell(row, number(child.visits), 'n');
+      cell(row, number(child.uniques), 'n');
+    });
+  }).catch(showError);
+}
+
+function route() {
+  var id = decodeURIComponent(location.hash.slice(1));
+  if (id) {
+    loadObject(id);
+  }
+}
+
+document.getElementById('period').addEventListener('change', loadOverview);
+document.getElementById('search').addEventListener('submit', function (e) {
+  e.preventDefault();
+  location.hash = encodeURIComponent(document.getElementById('object').value.trim());
+});
+document.getElementById('object').addEventListener('input', function () {
+  get('_objects?limit=20&prefix=' + encodeURIComponent(this.value)).then(function (response) {
+    var list = document.getElementById('objects');
+    list.textContent = '';
+    response.objects.forEach(function (o) {
+      var option = document.createElement('option');
+      option.value = o.id;
+      list.appendChild(option);
+    });
+  }).catch(showError);
+});
+window.addEventListener('hashchange', route);
+
+loadOverview();
+route();
+</script>
+</body>
+</html>
+`
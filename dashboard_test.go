@@ -0,0 +1,52 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+func signedInRequest(url, key string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth("dashboard", key)
+	w := httptest.NewRecorder()
+	Router().ServeHTTP(w, req)
+	return w
+}
+
+var _ = Describe("Dashboard", func() {
+	AfterEach(resetRedis)
+
+	It("should ask for a key with basic auth", func() {
+		w := request("GET", "/dashboard", "", "")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		Expect(w.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="beacon"`))
+
+		w = signedInRequest("/dashboard", "bk_nope")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should serve the dashboard for a read key", func() {
+		key, _ := CreateAPIKey(DefaultSite, "marketing", "read")
+		w := signedInRequest("/dashboard", key.Key)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Content-Type")).To(ContainSubstring("text/html"))
+		Expect(w.Body.String()).To(ContainSubstring("<title>Beacon Dashboard</title>"))
+	})
+
+	It("should hand the key to the page's scripts as a bearer token", func() {
+		key, _ := CreateAPIKey(DefaultSite, "marketing", "read")
+		w := signedInRequest("/dashboard", key.Key)
+		Expect(w.Body.String()).To(ContainSubstring(`var key = "` + key.Key + `";`))
+		Expect(w.Header().Get("Cache-Control")).To(Equal("private, no-store"))
+		Expect(request("GET", "/dashboard.html", "", "").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should not accept basic auth on the API", func() {
+		key, _ := CreateAPIKey(DefaultSite, "ops", "admin")
+		w := signedInRequest("/api/v1/_keys", key.Key)
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/mholt/binding"
+	"net/http"
+	"strconv"
+)
+
+// DedupJSON counts at most one visit per uid every Window seconds to the
+// objects matching Pattern, an object ID or a prefix ending in *.
+type DedupJSON struct {
+	Pattern string `json:"pattern"`
+	Window  int64  `json:"window"`
+}
+
+func (dedup *DedupJSON) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&dedup.Pattern: binding.Field{Form: "pattern", Required: true},
+		&dedup.Window:  binding.Field{Form: "window", Required: true},
+	}
+}
+
+func (dedup *DedupJSON) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	if dedup.Window <= 0 {
+		errs.Add([]string{"window"}, "ComplexError", "window must be a positive number of seconds")
+	}
+	return errs
+}
+
+func dedupKey(objectID, user string) string {
+	return "dedup_" + objectID + "_" + user
+}
+
+// dedupWindow is the window of the most specific pattern matching objectID,
+// or zero if none does.
+func dedupWindow(windows map[string]string, objectID string) (window int64) {
+	best := -1
+	for pattern, seconds := range windows {
+		if !matchesPattern(pattern, objectID) || len(pattern) <= best {
+			continue
+		}
+		if n, err := strconv.ParseInt(seconds, 10, 64); err == nil {
+			window, best = n, len(pattern)
+		}
+	}
+	return window
+}
+
+// isDuplicateVisit reports whether the visitor has already been counted
+// towards the event's object within its dedup window, starting a new window
+// if not.
+func isDuplicateVisit(conn redis.Conn, event *Event, windows map[string]string) (bool, error) {
+	window := dedupWindow(windows, event.Object)
+	if window == 0 {
+		return false, nil
+	}
+	reply, err := conn.Do("SET", dedupKey(event.Object, event.User), 1, "EX", window, "NX")
+	return err == nil && reply == nil, err
+}
+
+// GetDedupWindows returns every dedup pattern with its window in seconds.
+func GetDedupWindows(site *Site) (map[string]int64, error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	windows, err := stringMap(conn.Do("HGETALL", "dedup"))
+	if err != nil {
+		return nil, err
+	}
+	response := map[string]int64{}
+	for pattern, seconds := range windows {
+		response[pattern], _ = strconv.ParseInt(seconds, 10, 64)
+	}
+	return response, nil
+}
+
+// SetDedupWindow sets the dedup window for pattern; a zero window removes it.
+func SetDedupWindow(site *Site, pattern string, window int64) error {
+	conn := site.Conn()
+	defer conn.Close()
+	var err error
+	if window > 0 {
+		_, err = conn.Do("HSET", "dedup", pattern, window)
+	} else {
+		_, err = conn.Do("HDEL", "dedup", pattern)
+	}
+	siteDefinitions.forget(site)
+	return err
+}
+
+func apiDedupHandler(w http.ResponseWriter, req *http.Request) {
+	windows, err := GetDedupWindows(siteFor(req))
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(windows, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiDedupWriteHandler(w http.ResponseWriter, req *http.Request) {
+	dedup := new(DedupJSON)
+	if !bind(w, req, dedup) {
+		return
+	}
+	if err := SetDedupWindow(siteFor(req), dedup.Pattern, dedup.Window); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "set_dedup", "", dedup.Pattern+" "+strconv.FormatInt(dedup.Window, 10)); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiDedupDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	pattern := req.URL.Query().Get("pattern")
+	if pattern == "" {
+		jsonError(w, "Must pass pattern parameter", http.StatusBadRequest)
+		return
+	}
+	if err := SetDedupWindow(siteFor(req), pattern, 0); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "delete_dedup", "", pattern); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
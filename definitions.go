@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// definitions are the rarely changed settings every hit is checked against.
+type definitions struct {
+	dedup    map[string]string
+	goals    []Goal
+	funnels  []Funnel
+	private  []string
+	referers []string
+	expires  time.Time
+}
+
+// definitionCache keeps each site's definitions for DEFINITIONS_TTL, so the
+// tracker doesn't read them all again for every hit. Changes made on this
+// dyno are seen at once; those made on others once the TTL runs out.
+type definitionCache struct {
+	sync.Mutex
+	sites map[string]*definitions
+}
+
+var siteDefinitions = &definitionCache{sites: map[string]*definitions{}}
+
+// get returns the site's definitions, reading them through conn, which must
+// already be the site's, if they aren't cached.
+func (c *definitionCache) get(site *Site, conn redis.Conn) (*definitions, error) {
+	ttl := definitionsTTL()
+	now := time.Now()
+	if ttl > 0 {
+		c.Lock()
+		defs, ok := c.sites[site.prefix()]
+		c.Unlock()
+		if ok && now.Before(defs.expires) {
+			return defs, nil
+		}
+	}
+
+	defs, err := loadDefinitions(conn)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		defs.expires = now.Add(ttl)
+		c.Lock()
+		c.sites[site.prefix()] = defs
+		c.Unlock()
+	}
+	return defs, nil
+}
+
+// forget drops the site's definitions after they have been changed.
+func (c *definitionCache) forget(site *Site) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.sites, site.prefix())
+}
+
+// loadDefinitions reads every definition in one round trip.
+func loadDefinitions(conn redis.Conn) (defs *definitions, err error) {
+	conn.Send("HGETALL", "dedup")
+	conn.Send("HVALS", "goals")
+	conn.Send("HVALS", "funnels")
+	conn.Send("SMEMBERS", "private")
+	conn.Send("SMEMBERS", "referers")
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	defs = new(definitions)
+	if defs.dedup, err = stringMap(conn.Receive()); err != nil {
+		return nil, err
+	}
+	if defs.goals, err = decodeGoals(redis.Strings(conn.Receive())); err != nil {
+		return nil, err
+	}
+	if defs.funnels, err = decodeFunnels(redis.Strings(conn.Receive())); err != nil {
+		return nil, err
+	}
+	if defs.private, err = redis.Strings(conn.Receive()); err != nil {
+		return nil, err
+	}
+	if defs.referers, err = redis.Strings(conn.Receive()); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// DEFINITIONS_TTL is how many seconds each dyno reuses a site's goals,
+// funnels, dedup windows, private patterns and referer allow-list for (5 by
+// default).
+func definitionsTTL() time.Duration {
+	seconds, err := strconv.Atoi(ENV.Get("DEFINITIONS_TTL", "5"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// Scroll depth milestones, in percent of the page.
+var depthMilestones = []int{25, 50, 75, 100}
+
+type MilestoneJSON struct {
+	Depth   int     `json:"depth"`
+	Readers int64   `json:"readers"`
+	Rate    float64 `json:"rate"`
+}
+
+type DepthJSON struct {
+	Uniques    int64           `json:"uniques"`
+	Milestones []MilestoneJSON `json:"milestones"`
+}
+
+func depthKey(objectID string, depth int) string {
+	return "depth" + strconv.Itoa(depth) + "_" + objectID
+}
+
+func parseDepth(s string) (int, error) {
+	depth, err := strconv.Atoi(s)
+	if err == nil {
+		for _, milestone := range depthMilestones {
+			if depth == milestone {
+				return depth, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("depth must be one of %v", depthMilestones)
+}
+
+// Readers who reached a milestone have necessarily passed the ones before it,
+// so count them there too. This keeps the funnel monotonic even when a fast
+// scroll skips the earlier milestones.
+func trackDepth(conn redis.Conn, event *Event) {
+	for _, milestone := range depthMilestones {
+		if milestone > event.Depth {
+			break
+		}
+		conn.Send("PFADD", depthKey(event.Object, milestone), event.User)
+	}
+}
+
+func apiDepthHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	response, err := GetDepth(siteFor(req), vars["objectID"])
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func GetDepth(site *Site, objectID string) (dj DepthJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	conn.Send("PFCOUNT", "hll_"+objectID)
+	for _, milestone := range depthMilestones {
+		conn.Send("PFCOUNT", depthKey(objectID, milestone))
+	}
+	conn.Flush()
+
+	dj.Uniques, err = redis.Int64(conn.Receive())
+	if err != nil {
+		return dj, err
+	}
+	for _, milestone := range depthMilestones {
+		readers, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return dj, err
+		}
+		mj := MilestoneJSON{Depth: milestone, Readers: readers}
+		if dj.Uniques > 0 {
+			mj.Rate = float64(readers) / float64(dj.Uniques)
+		}
+		dj.Milestones = append(dj.Milestones, mj)
+	}
+	return dj, nil
+}
@@ -0,0 +1,51 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scroll depth", func() {
+	BeforeEach(func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "post", User: "jelder"},
+			{Object: "post", User: "cmbt"},
+			{Object: "post", User: "jelder", Depth: 100},
+			{Object: "post", User: "cmbt", Depth: 25},
+			{Object: "post", User: "cmbt", Depth: 50},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+	})
+	AfterEach(resetRedis)
+
+	Describe("api/v1/{objectID}/depth", func() {
+		var result DepthJSON
+
+		BeforeEach(func() {
+			result, _ = GetDepth(DefaultSite, "post")
+		})
+
+		It("should not count milestones as visits", func() {
+			Expect(result.Uniques).To(Equal(int64(2)))
+			visits, _ := Get(DefaultSite, "post")
+			Expect(visits.Visits).To(Equal(int64(2)))
+		})
+
+		It("should count readers passing each milestone", func() {
+			readers := []int64{}
+			for _, milestone := range result.Milestones {
+				readers = append(readers, milestone.Readers)
+			}
+			Expect(readers).To(Equal([]int64{2, 2, 1, 1}))
+		})
+
+		It("should report the share of uniques reaching each milestone", func() {
+			Expect(result.Milestones[3].Rate).To(Equal(0.5))
+		})
+	})
+})
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+const significanceLevel = 0.05
+
+var (
+	errUnknownControl = errors.New("control is not a variant of this experiment")
+
+	// Experiment and variant names come from anonymous tracking images, so
+	// they are kept short and free of the colon that separates them in keys
+	experimentName = regexp.MustCompile("^[A-Za-z0-9_.-]{1,64}$")
+)
+
+type VariantJSON struct {
+	Variant     string  `json:"variant"`
+	Exposures   int64   `json:"exposures"`
+	Visitors    int64   `json:"visitors"`
+	Conversions int64   `json:"conversions"`
+	Converters  int64   `json:"converters"`
+	Rate        float64 `json:"rate"`
+	Lift        float64 `json:"lift"`
+	Z           float64 `json:"z"`
+	PValue      float64 `json:"p_value"`
+	Significant bool    `json:"significant"`
+}
+
+type ExperimentReportJSON struct {
+	Experiment string        `json:"experiment"`
+	Goal       string        `json:"goal"`
+	Control    string        `json:"control"`
+	Variants   []VariantJSON `json:"variants"`
+}
+
+func variantsKey(experiment string) string {
+	return "variants_" + experiment
+}
+
+// Experiment and variant names can't contain the colon, so no two variants
+// share a key.
+func exposureHitsKey(experiment, variant string) string {
+	return "exphits_" + experiment + ":" + variant
+}
+
+func exposureHllKey(experiment, variant string) string {
+	return "exphll_" + experiment + ":" + variant
+}
+
+func conversionHitsKey(experiment, variant, goal string) string {
+	return "convhits_" + experiment + ":" + variant + ":" + goal
+}
+
+func conversionHllKey(experiment, variant, goal string) string {
+	return "convhll_" + experiment + ":" + variant + ":" + goal
+}
+
+// Which variant of each experiment a visitor has been shown, so later goal
+// completions can be credited to it.
+func assignmentsKey(user string) string {
+	return "experiments_" + user
+}
+
+func trackExposure(conn redis.Conn, event *Event) {
+	conn.Send("SADD", variantsKey(event.Experiment), event.Variant)
+	conn.Send("INCR", exposureHitsKey(event.Experiment, event.Variant))
+	conn.Send("PFADD", exposureHllKey(event.Experiment, event.Variant), event.User)
+	conn.Send("HSET", assignmentsKey(event.User), event.Experiment, event.Variant)
+	conn.Send("EXPIRE", assignmentsKey(event.User), visitorHistoryTTL)
+}
+
+// Assignments have to be read before the event is queued in the MULTI. An
+// exposure on the converting hit itself counts too.
+func experimentAssignments(event *Event, assigned map[string]string) map[string]string {
+	assignments := map[string]string{}
+	for experiment, variant := range assigned {
+		assignments[experiment] = variant
+	}
+	if event.Experiment != "" {
+		assignments[event.Experiment] = event.Variant
+	}
+	return assignments
+}
+
+func trackConversion(conn redis.Conn, event *Event, goal Goal, assignments map[string]string) {
+	for experiment, variant := range assignments {
+		conn.Send("INCR", conversionHitsKey(experiment, variant, goal.Name))
+		conn.Send("PFADD", conversionHllKey(experiment, variant, goal.Name), event.User)
+	}
+}
+
+// twoProportionTest compares the conversion rates of a variant against the
+// control, returning the z statistic and its two-tailed p-value.
+func twoProportionTest(controlConverters, controlVisitors, converters, visitors int64) (z, p float64) {
+	if controlVisitors == 0 || visitors == 0 {
+		return 0, 1
+	}
+	p1 := float64(controlConverters) / float64(controlVisitors)
+	p2 := float64(converters) / float64(visitors)
+	pooled := float64(controlConverters+converters) / float64(controlVisitors+visitors)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(controlVisitors) + 1/float64(visitors)))
+	if se == 0 {
+		return 0, 1
+	}
+	z = (p2 - p1) / se
+	return z, math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+func apiExperimentReportHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	query := req.URL.Query()
+	if query.Get("goal") == "" {
+		jsonError(w, "Must pass goal parameter", http.StatusBadRequest)
+		return
+	}
+
+	response, err := GetExperimentReport(siteFor(req), vars["name"], query.Get("goal"), query.Get("control"))
+	if err == redis.ErrNil {
+		jsonError(w, "No such experiment", http.StatusNotFound)
+		return
+	}
+	if err == errUnknownControl {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetExperimentReport compares each variant's unique conversion rate against
+// control, which defaults to the first variant in alphabetical order.
+func GetExperimentReport(site *Site, experiment, goal, control string) (report ExperimentReportJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	variants, err := redis.Strings(conn.Do("SMEMBERS", variantsKey(experiment)))
+	if err != nil {
+		return report, err
+	}
+	if len(variants) == 0 {
+		return report, redis.ErrNil
+	}
+	sort.Strings(variants)
+	if control == "" {
+		control = variants[0]
+	}
+	report = ExperimentReportJSON{Experiment: experiment, Goal: goal, Control: control}
+
+	for _, variant := range variants {
+		conn.Send("GET", exposureHitsKey(experiment, variant))
+		conn.Send("PFCOUNT", exposureHllKey(experiment, variant))
+		conn.Send("GET", conversionHitsKey(experiment, variant, goal))
+		conn.Send("PFCOUNT", conversionHllKey(experiment, variant, goal))
+	}
+	conn.Flush()
+
+	var controlJSON VariantJSON
+	for _, variant := range variants {
+		vj := VariantJSON{Variant: variant}
+		reply := make([]interface{}, 4)
+		for i := range reply {
+			if reply[i], err = conn.Receive(); err != nil {
+				return report, err
+			}
+		}
+		if _, err := redis.Scan(reply, &vj.Exposures, &vj.Visitors, &vj.Conversions, &vj.Converters); err != nil {
+			return report, err
+		}
+		if vj.Visitors > 0 {
+			vj.Rate = float64(vj.Converters) / float64(vj.Visitors)
+		}
+		if variant == control {
+			controlJSON = vj
+		}
+		report.Variants = append(report.Variants, vj)
+	}
+	if controlJSON.Variant == "" {
+		return report, errUnknownControl
+	}
+
+	for i := range report.Variants {
+		vj := &report.Variants[i]
+		if vj.Variant == control {
+			continue
+		}
+		if controlJSON.Rate > 0 {
+			vj.Lift = (vj.Rate - controlJSON.Rate) / controlJSON.Rate
+		}
+		vj.Z, vj.PValue = twoProportionTest(controlJSON.Converters, controlJSON.Visitors, vj.Converters, vj.Visitors)
+		vj.Significant = vj.PValue < significanceLevel
+	}
+	return report, nil
+}
@@ -0,0 +1,70 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var _ = Describe("Experiments", func() {
+	var report ExperimentReportJSON
+
+	BeforeEach(func() {
+		SaveGoal(DefaultSite, Goal{Name: "signup", Event: "signup"})
+
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for i := 0; i < 200; i++ {
+			user := strconv.Itoa(i)
+			event := Event{Object: "home", User: user, Experiment: "hero", Variant: "a"}
+			if i%2 == 1 {
+				event.Variant = "b"
+			}
+			event.Track(conn)
+
+			// One in ten converts on a, one in two on b
+			if (event.Variant == "a" && i%20 == 0) || (event.Variant == "b" && i%4 == 1) {
+				signup := Event{Object: "home", User: user, Name: "signup"}
+				signup.Track(conn)
+			}
+		}
+		report, _ = GetExperimentReport(DefaultSite, "hero", "signup", "")
+	})
+	AfterEach(resetRedis)
+
+	It("should count exposures and conversions per variant", func() {
+		Expect(report.Control).To(Equal("a"))
+		Expect(report.Variants).To(HaveLen(2))
+		Expect(report.Variants[0].Visitors).To(BeNumerically("~", 100, 2))
+		Expect(report.Variants[0].Converters).To(BeNumerically("~", 10, 1))
+		Expect(report.Variants[1].Converters).To(BeNumerically("~", 50, 1))
+	})
+
+	It("should test the difference in conversion rates", func() {
+		Expect(report.Variants[0].Significant).To(BeFalse())
+		Expect(report.Variants[1].Z).To(BeNumerically(">", 0))
+		Expect(report.Variants[1].PValue).To(BeNumerically("<", 0.001))
+		Expect(report.Variants[1].Significant).To(BeTrue())
+	})
+
+	It("should keep variants whose names run together apart", func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		(&Event{Object: "home", User: "x", Experiment: "checkout", Variant: "a_b"}).Track(conn)
+		(&Event{Object: "home", User: "y", Experiment: "checkout_a", Variant: "b"}).Track(conn)
+		(&Event{Object: "home", User: "y", Experiment: "checkout_a", Variant: "b"}).Track(conn)
+
+		checkout, _ := GetExperimentReport(DefaultSite, "checkout", "signup", "")
+		Expect(checkout.Variants).To(HaveLen(1))
+		Expect(checkout.Variants[0].Exposures).To(BeEquivalentTo(1))
+	})
+
+	It("should refuse malformed experiment and variant names", func() {
+		Expect(request("GET", "/home.png?experiment=hero&variant=a:b", "", "").Code).To(Equal(http.StatusBadRequest))
+		Expect(request("GET", "/home.png?experiment=hero&variant="+strings.Repeat("b", 65), "", "").Code).To(Equal(http.StatusBadRequest))
+		Expect(request("GET", "/home.png?experiment=hero&variant=c", "", "").Code).To(Equal(http.StatusOK))
+	})
+})
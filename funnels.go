@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultFunnelWindow = 60 * 60 * 24 * 7
+
+// A Funnel is an ordered list of object IDs. A visitor reaches a step only by
+// visiting it after the previous one, within Window seconds of the first.
+type Funnel struct {
+	Name   string   `json:"name"`
+	Steps  []string `json:"steps"`
+	Window int64    `json:"window"`
+}
+
+func (funnel *Funnel) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&funnel.Name:   binding.Field{Form: "name", Required: true},
+		&funnel.Steps:  binding.Field{Form: "steps", Required: true},
+		&funnel.Window: "window",
+	}
+}
+
+func (funnel *Funnel) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	if strings.Contains(funnel.Name, ":") {
+		errs.Add([]string{"name"}, "ComplexError", "name must not contain a colon")
+	}
+	if len(funnel.Steps) < 2 {
+		errs.Add([]string{"steps"}, "ComplexError", "A funnel needs at least two steps")
+	}
+	if funnel.Window < 0 {
+		errs.Add([]string{"window"}, "ComplexError", "window must not be negative")
+	}
+	return errs
+}
+
+type FunnelStepJSON struct {
+	Object     string  `json:"object"`
+	Uniques    int64   `json:"uniques"`
+	Conversion float64 `json:"conversion"`
+	DropOff    float64 `json:"drop_off"`
+}
+
+type FunnelReportJSON struct {
+	Funnel Funnel           `json:"funnel"`
+	From   string           `json:"from"`
+	To     string           `json:"to"`
+	Steps  []FunnelStepJSON `json:"steps"`
+}
+
+// funnelStep records that a visitor just reached step of funnel.
+type funnelStep struct {
+	funnel Funnel
+	step   int
+}
+
+// The visitor's progress through a funnel is the index of the last step they
+// reached. It expires when the conversion window closes, and INCR preserves
+// that expiry as they advance. Funnel names can't contain the colon, so no two
+// funnels share a key.
+func funnelProgressKey(name, user string) string {
+	return "funnel_" + name + ":" + user
+}
+
+func funnelHllKey(name string, step int, date string) string {
+	return "funnelhll_" + date + "_" + name + ":" + strconv.Itoa(step)
+}
+
+func loadFunnels(conn redis.Conn) ([]Funnel, error) {
+	return decodeFunnels(redis.Strings(conn.Do("HVALS", "funnels")))
+}
+
+func decodeFunnels(values []string, err error) (funnels []Funnel, _ error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		var funnel Funnel
+		if err := json.Unmarshal([]byte(value), &funnel); err != nil {
+			return nil, err
+		}
+		funnels = append(funnels, funnel)
+	}
+	return funnels, nil
+}
+
+// Like goals, funnel progress has to be read before the event is queued in
+// the MULTI. progress holds the visitor's last step in each funnel, or -1.
+func reachedFunnelSteps(event *Event, funnels []Funnel, progress []int) (reached []funnelStep) {
+	for i, funnel := range funnels {
+		if i >= len(progress) {
+			break
+		}
+		step := progress[i]
+		if step < 0 && funnel.Steps[0] == event.Object {
+			reached = append(reached, funnelStep{funnel, 0})
+		} else if step >= 0 && step+1 < len(funnel.Steps) && funnel.Steps[step+1] == event.Object {
+			reached = append(reached, funnelStep{funnel, step + 1})
+		}
+	}
+	return reached
+}
+
+func trackFunnelStep(conn redis.Conn, event *Event, reached funnelStep) {
+	progressKey := funnelProgressKey(reached.funnel.Name, event.User)
+	if reached.step == 0 {
+		window := reached.funnel.Window
+		if window == 0 {
+			window = defaultFunnelWindow
+		}
+		conn.Send("SET", progressKey, 0, "EX", window)
+	} else {
+		conn.Send("INCR", progressKey)
+	}
+	conn.Send("PFADD", funnelHllKey(reached.funnel.Name, reached.step, day(event.time())), event.User)
+}
+
+func apiFunnelsHandler(w http.ResponseWriter, req *http.Request) {
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+
+	funnels, err := loadFunnels(conn)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if funnels == nil {
+		funnels = []Funnel{}
+	}
+
+	js, _ := json.MarshalIndent(funnels, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiFunnelWriteHandler(w http.ResponseWriter, req *http.Request) {
+	funnel := new(Funnel)
+	if !bind(w, req, funnel) {
+		return
+	}
+	if err := SaveFunnel(siteFor(req), *funnel); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, _ := json.Marshal(funnel)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func SaveFunnel(site *Site, funnel Funnel) error {
+	conn := site.Conn()
+	defer conn.Close()
+	js, _ := json.Marshal(funnel)
+	_, err := conn.Do("HSET", "funnels", funnel.Name, js)
+	siteDefinitions.forget(site)
+	return err
+}
+
+func apiFunnelDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if _, err := conn.Do("HDEL", "funnels", vars["name"]); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	siteDefinitions.forget(siteFor(req))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiFunnelReportHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := GetFunnelReport(siteFor(req), vars["name"], from, to)
+	if err == redis.ErrNil {
+		jsonError(w, "No such funnel", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func GetFunnelReport(site *Site, name string, from, to time.Time) (report FunnelReportJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("HGET", "funnels", name))
+	if err != nil {
+		return report, err
+	}
+	if err = json.Unmarshal(js, &report.Funnel); err != nil {
+		return report, err
+	}
+	report.From, report.To = day(from), day(to)
+
+	dates := days(from, to)
+	for step := range report.Funnel.Steps {
+		hllKeys := []string{}
+		for _, date := range dates {
+			hllKeys = append(hllKeys, funnelHllKey(name, step, date))
+		}
+		conn.Send("PFCOUNT", redis.Args{}.AddFlat(hllKeys)...)
+	}
+	conn.Flush()
+
+	for step, object := range report.Funnel.Steps {
+		sj := FunnelStepJSON{Object: object, Conversion: 1}
+		if sj.Uniques, err = redis.Int64(conn.Receive()); err != nil {
+			return report, err
+		}
+		if step > 0 {
+			// A visitor who reached this step in the range may have reached
+			// the one before it earlier, so counts are capped to keep the
+			// funnel narrowing
+			previous := report.Steps[step-1].Uniques
+			if sj.Uniques > previous {
+				sj.Uniques = previous
+			}
+			sj.Conversion = 0
+			if previous > 0 {
+				sj.Conversion = float64(sj.Uniques) / float64(previous)
+			}
+			sj.DropOff = 1 - sj.Conversion
+		}
+		report.Steps = append(report.Steps, sj)
+	}
+	return report, nil
+}
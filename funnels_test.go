@@ -0,0 +1,77 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Funnels", func() {
+	var report FunnelReportJSON
+
+	BeforeEach(func() {
+		SaveFunnel(DefaultSite, Funnel{Name: "signup", Steps: []string{"landing", "pricing", "signup"}})
+
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "landing", User: "jelder"},
+			{Object: "pricing", User: "jelder"},
+			{Object: "signup", User: "jelder"},
+			{Object: "landing", User: "cmbt"},
+			{Object: "signup", User: "cmbt"},
+			{Object: "pricing", User: "cmbt"},
+			{Object: "pricing", User: "skipper"},
+			{Object: "signup", User: "skipper"},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+
+		today := time.Now().UTC()
+		report, _ = GetFunnelReport(DefaultSite, "signup", today, today)
+	})
+	AfterEach(resetRedis)
+
+	It("should count uniques reaching each step in order", func() {
+		uniques := []int64{}
+		for _, step := range report.Steps {
+			uniques = append(uniques, step.Uniques)
+		}
+		Expect(uniques).To(Equal([]int64{2, 2, 1}))
+	})
+
+	It("should report drop-off between steps", func() {
+		Expect(report.Steps[0].DropOff).To(Equal(0.0))
+		Expect(report.Steps[2].DropOff).To(Equal(0.5))
+	})
+	It("should keep funnels whose names and visitors run together apart", func() {
+		SaveFunnel(DefaultSite, Funnel{Name: "a_b", Steps: []string{"x", "y"}})
+		SaveFunnel(DefaultSite, Funnel{Name: "a", Steps: []string{"w", "y"}})
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for _, event := range []Event{{Object: "x", User: "c"}, {Object: "w", User: "d"}, {Object: "y", User: "b_c"}} {
+			event.Track(conn)
+		}
+		today := time.Now().UTC()
+		report, _ := GetFunnelReport(DefaultSite, "a", today, today)
+		Expect(report.Steps[1].Uniques).To(Equal(int64(0)))
+	})
+
+	It("should never convert more than the step before", func() {
+		SaveFunnel(DefaultSite, Funnel{Name: "trial", Steps: []string{"pricing", "trial"}})
+		conn := RedisPool.Get()
+		defer conn.Close()
+		today := time.Now().UTC()
+		for _, event := range []Event{
+			{Object: "pricing", User: "jelder", Time: today.AddDate(0, 0, -1)},
+			{Object: "trial", User: "jelder", Time: today},
+		} {
+			event.Track(conn)
+		}
+		report, _ := GetFunnelReport(DefaultSite, "trial", today, today)
+		Expect(report.Steps[1].Uniques).To(Equal(int64(0)))
+		Expect(report.Steps[1].Conversion).To(Equal(0.0))
+	})
+})
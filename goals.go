@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"net/http"
+	"time"
+)
+
+// A Goal is completed when a visitor either reaches Object (optionally only
+// after having visited After), or fires the custom event Event.
+type Goal struct {
+	Name   string `json:"name"`
+	Object string `json:"object,omitempty"`
+	After  string `json:"after,omitempty"`
+	Event  string `json:"event,omitempty"`
+}
+
+func (goal *Goal) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&goal.Name:   binding.Field{Form: "name", Required: true},
+		&goal.Object: "object",
+		&goal.After:  "after",
+		&goal.Event:  "event",
+	}
+}
+
+func (goal *Goal) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	if (goal.Object == "") == (goal.Event == "") {
+		errs.Add([]string{"object", "event"}, "ComplexError", "Exactly one of object or event is required")
+	}
+	if goal.After != "" && goal.Object == "" {
+		errs.Add([]string{"after"}, "ComplexError", "after only applies to object goals")
+	}
+	return errs
+}
+
+type GoalDayJSON struct {
+	Date        string `json:"date"`
+	Completions int64  `json:"completions"`
+	Converters  int64  `json:"converters"`
+}
+
+type GoalReportJSON struct {
+	Goal        Goal          `json:"goal"`
+	Completions int64         `json:"completions"`
+	Converters  int64         `json:"converters"`
+	Days        []GoalDayJSON `json:"days"`
+}
+
+func goalHitsKey(name, date string) string {
+	return "goalhits_" + date + "_" + name
+}
+
+func goalHllKey(name, date string) string {
+	return "goalhll_" + date + "_" + name
+}
+
+func (goal *Goal) matches(event *Event, history map[string]string) bool {
+	if goal.Event != "" {
+		return event.Name == goal.Event
+	}
+	if event.Name != "" || event.Depth > 0 || event.Object != goal.Object {
+		return false
+	}
+	if goal.After == "" {
+		return true
+	}
+	_, ok := history[goal.After]
+	return ok
+}
+
+func loadGoals(conn redis.Conn) ([]Goal, error) {
+	return decodeGoals(redis.Strings(conn.Do("HVALS", "goals")))
+}
+
+func decodeGoals(values []string, err error) (goals []Goal, _ error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		var goal Goal
+		if err := json.Unmarshal([]byte(value), &goal); err != nil {
+			return nil, err
+		}
+		goals = append(goals, goal)
+	}
+	return goals, nil
+}
+
+// Goals are evaluated before the event is queued in the MULTI, since "after"
+// goals need to read the visitor's history as it was before this hit.
+func completedGoals(event *Event, goals []Goal, history map[string]string) (completed []Goal) {
+	for _, goal := range goals {
+		if goal.matches(event, history) {
+			completed = append(completed, goal)
+		}
+	}
+	return completed
+}
+
+func trackGoal(conn redis.Conn, event *Event, goal Goal) {
+	date := day(event.time())
+	conn.Send("INCR", goalHitsKey(goal.Name, date))
+	conn.Send("PFADD", goalHllKey(goal.Name, date), event.User)
+}
+
+func apiGoalsHandler(w http.ResponseWriter, req *http.Request) {
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+
+	goals, err := loadGoals(conn)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if goals == nil {
+		goals = []Goal{}
+	}
+
+	js, _ := json.MarshalIndent(goals, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiGoalWriteHandler(w http.ResponseWriter, req *http.Request) {
+	goal := new(Goal)
+	if !bind(w, req, goal) {
+		return
+	}
+	if err := SaveGoal(siteFor(req), *goal); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, _ := json.Marshal(goal)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func SaveGoal(site *Site, goal Goal) error {
+	conn := site.Conn()
+	defer conn.Close()
+	js, _ := json.Marshal(goal)
+	_, err := conn.Do("HSET", "goals", goal.Name, js)
+	siteDefinitions.forget(site)
+	return err
+}
+
+func apiGoalDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if _, err := conn.Do("HDEL", "goals", vars["name"]); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	siteDefinitions.forget(siteFor(req))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiGoalReportHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := GetGoalReport(siteFor(req), vars["name"], from, to)
+	if err == redis.ErrNil {
+		jsonError(w, "No such goal", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func GetGoalReport(site *Site, name string, from, to time.Time) (report GoalReportJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("HGET", "goals", name))
+	if err != nil {
+		return report, err
+	}
+	if err = json.Unmarshal(js, &report.Goal); err != nil {
+		return report, err
+	}
+
+	dates := days(from, to)
+	hllKeys := []string{}
+	for _, date := range dates {
+		conn.Send("GET", goalHitsKey(name, date))
+		conn.Send("PFCOUNT", goalHllKey(name, date))
+		hllKeys = append(hllKeys, goalHllKey(name, date))
+	}
+	conn.Send("PFCOUNT", redis.Args{}.AddFlat(hllKeys)...)
+	conn.Flush()
+
+	for _, date := range dates {
+		dj := GoalDayJSON{Date: date}
+		if dj.Completions, err = redis.Int64(conn.Receive()); err != nil && err != redis.ErrNil {
+			return report, err
+		}
+		if dj.Converters, err = redis.Int64(conn.Receive()); err != nil {
+			return report, err
+		}
+		report.Completions += dj.Completions
+		report.Days = append(report.Days, dj)
+	}
+	report.Converters, err = redis.Int64(conn.Receive())
+	return report, err
+}
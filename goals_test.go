@@ -0,0 +1,70 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Goals", func() {
+	BeforeEach(func() {
+		SaveGoal(DefaultSite, Goal{Name: "pricing_to_thanks", Object: "thanks", After: "pricing"})
+		SaveGoal(DefaultSite, Goal{Name: "signup", Event: "signup"})
+
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "thanks", User: "jelder"},
+			{Object: "pricing", User: "cmbt"},
+			{Object: "thanks", User: "cmbt"},
+			{Object: "thanks", User: "cmbt"},
+			{Object: "home", User: "jelder", Name: "signup"},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+	})
+	AfterEach(resetRedis)
+
+	today := time.Now().UTC()
+
+	It("should only count object goals reached after the prerequisite", func() {
+		report, err := GetGoalReport(DefaultSite, "pricing_to_thanks", today, today)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Completions).To(Equal(int64(2)))
+		Expect(report.Converters).To(Equal(int64(1)))
+	})
+
+	It("should count custom event goals", func() {
+		report, _ := GetGoalReport(DefaultSite, "signup", today, today)
+		Expect(report.Completions).To(Equal(int64(1)))
+		Expect(report.Days).To(HaveLen(1))
+	})
+
+	It("should reuse goals for DEFINITIONS_TTL until they are changed", func() {
+		ENV["DEFINITIONS_TTL"] = "60"
+		defer func() { ENV["DEFINITIONS_TTL"] = "0" }()
+		conn := RedisPool.Get()
+		defer conn.Close()
+		event := Event{Object: "home", User: "cmbt", Name: "signup"}
+		event.Track(conn)
+
+		// As if another dyno had added it
+		conn.Do("HSET", "goals", "subscribe", `{"name":"subscribe","event":"subscribe"}`)
+		event = Event{Object: "home", User: "cmbt", Name: "subscribe"}
+		event.Track(conn)
+		report, _ := GetGoalReport(DefaultSite, "subscribe", today, today)
+		Expect(report.Completions).To(Equal(int64(0)))
+
+		SaveGoal(DefaultSite, Goal{Name: "subscribe", Event: "subscribe"})
+		event.Track(conn)
+		report, _ = GetGoalReport(DefaultSite, "subscribe", today, today)
+		Expect(report.Completions).To(Equal(int64(1)))
+	})
+
+	It("should not count custom events as visits", func() {
+		result, _ := GetMulti(DefaultSite, []string{"home"}, false)
+		Expect(result.Visits).To(Equal(int64(0)))
+	})
+})
@@ -0,0 +1,60 @@
+package main_test
+
+import (
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("Hierarchical objects", func() {
+	BeforeEach(func() {
+		ENV["HIERARCHY_SEPARATOR"] = "/"
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "blog/2014/post_1", User: "jelder"},
+			{Object: "blog/2015/post_2", User: "jelder"},
+			{Object: "blog/2015/post_3", User: "cmbt"},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+	})
+	AfterEach(func() {
+		delete(ENV, "HIERARCHY_SEPARATOR")
+		resetRedis()
+	})
+
+	It("should roll hits up into every ancestor", func() {
+		result, _ := Get(DefaultSite, "blog")
+		Expect(result).To(Equal(TrackJSON{Visits: 3, Uniques: 2}))
+		result, _ = Get(DefaultSite, "blog/2015")
+		Expect(result).To(Equal(TrackJSON{Visits: 2, Uniques: 2}))
+		result, _ = Get(DefaultSite, "blog/2015/post_3")
+		Expect(result).To(Equal(TrackJSON{Visits: 1, Uniques: 1}))
+	})
+
+	It("should keep private objects out of public groups", func() {
+		SetPrivate(DefaultSite, "blog/drafts/*", true)
+		SetPrivate(DefaultSite, "blog/drafts", true)
+		conn := RedisPool.Get()
+		defer conn.Close()
+		event := Event{Object: "blog/drafts/post_4", User: "skipper"}
+		event.Track(conn)
+
+		result, _ := Get(DefaultSite, "blog")
+		Expect(result).To(Equal(TrackJSON{Visits: 3, Uniques: 2}))
+		result, _ = Get(DefaultSite, "blog/drafts")
+		Expect(result).To(Equal(TrackJSON{Visits: 1, Uniques: 1}))
+	})
+
+	It("should serve groups from the object API", func() {
+		w := request("GET", "/api/v1/blog/2015", "", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+		var result TrackJSON
+		json.Unmarshal(w.Body.Bytes(), &result)
+		Expect(result.Visits).To(Equal(int64(2)))
+	})
+})
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Comments sent on idle streams, well within the Heroku router's 55
+	// second timeout
+	liveHeartbeat = 30 * time.Second
+
+	// Every dyno subscribes once, to updates for every site's objects
+	liveChannelPattern = "*live_*"
+)
+
+var (
+	liveConnections int64
+	hub             = &liveHub{listeners: map[string]map[chan struct{}]bool{}, ready: make(chan struct{})}
+)
+
+// The tracker publishes to an object's live channel whenever it is visited.
+func liveChannel(objectID string) string {
+	return "live_" + objectID
+}
+
+// liveHub relays the tracker's notifications from Redis to the streams
+// listening on this dyno.
+type liveHub struct {
+	sync.Mutex
+	listeners map[string]map[chan struct{}]bool
+	start     sync.Once
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// listen returns a channel which receives a value whenever channel is
+// published to, coalescing bursts, and a func to stop listening.
+func (hub *liveHub) listen(channel string) (chan struct{}, func()) {
+	hub.start.Do(func() { go hub.run() })
+	select {
+	case <-hub.ready:
+	case <-time.After(5 * time.Second):
+	}
+
+	updates := make(chan struct{}, 1)
+	hub.Lock()
+	if hub.listeners[channel] == nil {
+		hub.listeners[channel] = map[chan struct{}]bool{}
+	}
+	hub.listeners[channel][updates] = true
+	hub.Unlock()
+
+	return updates, func() {
+		hub.Lock()
+		defer hub.Unlock()
+		delete(hub.listeners[channel], updates)
+		if len(hub.listeners[channel]) == 0 {
+			delete(hub.listeners, channel)
+		}
+	}
+}
+
+func (hub *liveHub) notify(channel string) {
+	hub.Lock()
+	defer hub.Unlock()
+	for updates := range hub.listeners[channel] {
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run subscribes to every live channel, resubscribing if the connection to
+// Redis is lost.
+func (hub *liveHub) run() {
+	for {
+		psc := redis.PubSubConn{Conn: RedisPool.Get()}
+		err := psc.PSubscribe(liveChannelPattern)
+		for err == nil {
+			switch v := psc.Receive().(type) {
+			case redis.Subscription:
+				hub.readyOnce.Do(func() { close(hub.ready) })
+			case redis.PMessage:
+				hub.notify(v.Channel)
+			case error:
+				err = v
+			}
+		}
+		fmt.Print(err)
+		psc.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// apiLiveHandler streams an object's visits and uniques as server-sent
+// events: once on connecting, then as they change, at most every
+// LIVE_INTERVAL seconds.
+func apiLiveHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if atomic.AddInt64(&liveConnections, 1) > liveMaxConnections() {
+		atomic.AddInt64(&liveConnections, -1)
+		w.Header().Set("Retry-After", "30")
+		jsonError(w, "Too many live connections; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt64(&liveConnections, -1)
+
+	site := siteFor(req)
+	objectID := mux.Vars(req)["objectID"]
+	updates, stop := hub.listen(site.prefix() + liveChannel(objectID))
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	var last TrackJSON
+	var lastSent time.Time
+	emit := func(force bool) error {
+		tj, err := Get(site, objectID)
+		if err != nil {
+			fmt.Print(err)
+			return nil
+		}
+		lastSent = time.Now()
+		if !force && tj.Visits == last.Visits && tj.Uniques == last.Uniques {
+			return nil
+		}
+		last = tj
+		js, _ := json.Marshal(tj)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", js); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if emit(true) != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	var throttled <-chan time.Time
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-updates:
+			if throttled == nil {
+				throttled = time.After(lastSent.Add(liveInterval()).Sub(time.Now()))
+			}
+		case <-throttled:
+			throttled = nil
+			if emit(false) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main_test
+
+import (
+	"bufio"
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// nextEvent reads the data of the next server-sent event.
+func nextEvent(reader *bufio.Reader) (tj TrackJSON) {
+	for {
+		line, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		if strings.HasPrefix(line, "data: ") {
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &tj)
+			return tj
+		}
+	}
+}
+
+var _ = Describe("Live counts", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		ENV["LIVE_INTERVAL"] = "0"
+		server = httptest.NewServer(Router())
+	})
+	AfterEach(func() {
+		server.Close()
+		delete(ENV, "LIVE_INTERVAL")
+		delete(ENV, "LIVE_MAX_CONNECTIONS")
+		resetRedis()
+	})
+
+	It("should stream counts as they change", func() {
+		trackVisit("live", "jelder")
+		resp, err := http.Get(server.URL + "/api/v1/live/live")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		reader := bufio.NewReader(resp.Body)
+		Expect(nextEvent(reader)).To(Equal(TrackJSON{Visits: 1, Uniques: 1}))
+		trackVisit("live", "cmbt")
+		Expect(nextEvent(reader)).To(Equal(TrackJSON{Visits: 2, Uniques: 2}))
+	})
+
+	It("should limit the number of streams", func() {
+		ENV["LIVE_MAX_CONNECTIONS"] = "1"
+		resp, err := http.Get(server.URL + "/api/v1/live/live")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		nextEvent(bufio.NewReader(resp.Body))
+
+		second, err := http.Get(server.URL + "/api/v1/live/live")
+		Expect(err).NotTo(HaveOccurred())
+		second.Body.Close()
+		Expect(second.StatusCode).To(Equal(http.StatusServiceUnavailable))
+	})
+})
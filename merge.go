@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolveAlias returns the object a merged object's hits are now recorded
+// under, or objectID itself.
+func resolveAlias(conn redis.Conn, objectID string) (string, error) {
+	into, err := redis.String(conn.Do("HGET", "aliases", objectID))
+	if err == redis.ErrNil {
+		return objectID, nil
+	} else if err != nil {
+		return objectID, err
+	}
+	return into, nil
+}
+
+// Merges are retried this many times if from is hit while they are underway,
+// waiting a little longer before each retry so a busy object gets a gap.
+const (
+	maxMergeAttempts = 10
+	mergeBackoff     = 10 * time.Millisecond
+)
+
+// MergeObject folds everything recorded about from into into, then deletes
+// from. Counters are summed and HyperLogLogs merged, so uniques who visited
+// both are only counted once. With alias, future hits on from are recorded
+// under into.
+func MergeObject(site *Site, from, into string, alias bool) error {
+	if from == into {
+		return fmt.Errorf("Can't merge an object into itself")
+	}
+	conn := site.Conn()
+	defer conn.Close()
+
+	for attempt := 0; attempt < maxMergeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * mergeBackoff)
+		}
+		merged, err := mergeObject(conn, site, from, into, alias, time.Now())
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if merged {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is too busy to merge; try again", from)
+}
+
+// mergeObject makes one attempt at a merge. Everything it reads about from is
+// watched, so should a hit change any of it before the MULTI runs, nothing is
+// written and merged is false.
+func mergeObject(conn redis.Conn, site *Site, from, into string, alias bool, now time.Time) (merged bool, err error) {
+	counters := []string{"hits_", "visits_", "uniques_"}
+	var values []interface{}
+	for _, counter := range counters {
+		values = append(values, counter+from)
+	}
+
+	// PFMERGE creates its destination, so only merge HyperLogLogs which exist
+	lifetimeHlls := []string{"hll_" + from}
+	for _, milestone := range depthMilestones {
+		lifetimeHlls = append(lifetimeHlls, depthKey(from, milestone))
+	}
+	dayHlls, topKeys := bucketKeys(site, from, now)
+	hllKeys := append(lifetimeHlls, dayHlls...)
+
+	watched := redis.Args{}.Add(values...).Add(referralsKey(from), "aliases").AddFlat(hllKeys)
+	if _, err := conn.Do("WATCH", watched...); err != nil {
+		return false, err
+	}
+	reply, err := redis.Values(conn.Do("MGET", values...))
+	if err != nil {
+		return false, err
+	}
+	counts := make([]int64, len(counters))
+	for i := range counters {
+		if _, err := redis.Scan(reply[i:i+1], &counts[i]); err != nil {
+			return false, err
+		}
+	}
+
+	for _, key := range hllKeys {
+		conn.Send("EXISTS", key)
+	}
+	for _, key := range topKeys {
+		conn.Send("ZSCORE", key, from)
+	}
+	conn.Send("HMGET", "objects_first", from, into)
+	conn.Send("HMGET", "objects_last", from, into)
+	conn.Send("HGETALL", "aliases")
+	conn.Flush()
+
+	exists := make([]bool, len(hllKeys))
+	for i := range hllKeys {
+		if exists[i], err = redis.Bool(conn.Receive()); err != nil {
+			return false, err
+		}
+	}
+	scores := make([]interface{}, len(topKeys))
+	for i := range topKeys {
+		if scores[i], err = conn.Receive(); err != nil {
+			return false, err
+		}
+	}
+	var firstFrom, firstInto, lastFrom, lastInto int64
+	firstSeen, err := redis.Values(conn.Receive())
+	if err != nil {
+		return false, err
+	}
+	lastSeen, err := redis.Values(conn.Receive())
+	if err != nil {
+		return false, err
+	}
+	if _, err := redis.Scan(append(firstSeen, lastSeen...), &firstFrom, &firstInto, &lastFrom, &lastInto); err != nil {
+		return false, err
+	}
+	aliases, err := stringMap(conn.Receive())
+	if err != nil {
+		return false, err
+	}
+
+	conn.Send("MULTI")
+	for i, counter := range counters {
+		if counts[i] != 0 {
+			conn.Send("INCRBY", counter+into, counts[i])
+		}
+	}
+	// Every per-object key ends with the object ID
+	for i, key := range hllKeys {
+		if !exists[i] {
+			continue
+		}
+		intoKey := strings.TrimSuffix(key, from) + into
+		conn.Send("PFMERGE", intoKey, intoKey, key)
+		if i >= len(lifetimeHlls) {
+			conn.Send("EXPIRE", intoKey, site.periodTTL())
+		}
+	}
+	conn.Send("ZUNIONSTORE", referralsKey(into), 2, referralsKey(into), referralsKey(from))
+	for i, key := range topKeys {
+		if scores[i] != nil {
+			score, _ := redis.Float64(scores[i], nil)
+			conn.Send("ZINCRBY", key, score, into)
+		}
+	}
+	if firstFrom != 0 {
+		conn.Send("ZADD", "objects", 0, into)
+		if firstInto == 0 || firstFrom < firstInto {
+			conn.Send("HSET", "objects_first", into, firstFrom)
+		}
+		if lastFrom > lastInto {
+			conn.Send("HSET", "objects_last", into, lastFrom)
+		}
+	}
+	// Keep earlier aliases pointing at the object which now holds their stats
+	for alias, target := range aliases {
+		if target == from {
+			conn.Send("HSET", "aliases", alias, into)
+		}
+	}
+	if alias {
+		conn.Send("HSET", "aliases", from, into)
+	}
+	conn.Send("HDEL", "aliases", into)
+	deleteObject(conn, site, from, now)
+
+	// EXEC replies nil when a watched key changed
+	exec, err := conn.Do("EXEC")
+	return exec != nil, err
+}
+
+func apiMergeHandler(w http.ResponseWriter, req *http.Request) {
+	from := mux.Vars(req)["objectID"]
+	query := req.URL.Query()
+	into := query.Get("into")
+	if into == "" || into == from {
+		jsonError(w, "Must pass into parameter naming another object", http.StatusBadRequest)
+		return
+	}
+	alias, _ := strconv.ParseBool(query.Get("alias"))
+
+	if err := MergeObject(siteFor(req), from, into, alias); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "merge", from, "into "+into); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultObjectsLimit = 100
+	maxObjectsLimit     = 1000
+)
+
+type ObjectJSON struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type ObjectsJSON struct {
+	Objects []ObjectJSON `json:"objects"`
+	Cursor  string       `json:"cursor,omitempty"`
+}
+
+// Every object ID is indexed in a sorted set with equal scores, so it can be
+// paged through in lexicographical order and filtered by prefix with
+// ZRANGEBYLEX.
+func indexObject(conn redis.Conn, event *Event) {
+	seen := event.time().Unix()
+	conn.Send("ZADD", "objects", 0, event.Object)
+	conn.Send("HSETNX", "objects_first", event.Object, seen)
+	conn.Send("HSET", "objects_last", event.Object, seen)
+}
+
+func apiObjectsHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	limit := defaultObjectsLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxObjectsLimit {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxObjectsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, err := GetObjects(siteFor(req), query.Get("prefix"), query.Get("cursor"), limit)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Private objects are left out for anonymous requests, though the page's
+	// cursor still counts them
+	ids := []string{}
+	for _, object := range response.Objects {
+		ids = append(ids, object.ID)
+	}
+	public, err := publicObjects(req, ids)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	visible := map[string]bool{}
+	for _, id := range public {
+		visible[id] = true
+	}
+	objects := response.Objects[:0]
+	for _, object := range response.Objects {
+		if visible[object.ID] {
+			objects = append(objects, object)
+		}
+	}
+	response.Objects = objects
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetObjects lists up to limit tracked objects whose IDs start with prefix,
+// after cursor. The returned Cursor fetches the next page, and is empty on the
+// last one.
+func GetObjects(site *Site, prefix, cursor string, limit int) (oj ObjectsJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	min, max := "-", "+"
+	if prefix != "" {
+		min, max = "["+prefix, "["+prefix+"\xff"
+	}
+	if cursor > prefix {
+		min = "(" + cursor
+	}
+	ids, err := redis.Strings(conn.Do("ZRANGEBYLEX", "objects", min, max, "LIMIT", 0, limit+1))
+	if err != nil {
+		return oj, err
+	}
+	if len(ids) > limit {
+		ids = ids[:limit]
+		oj.Cursor = ids[limit-1]
+	}
+
+	oj.Objects = []ObjectJSON{}
+	if len(ids) == 0 {
+		return oj, nil
+	}
+	conn.Send("HMGET", redis.Args{"objects_first"}.AddFlat(ids)...)
+	conn.Send("HMGET", redis.Args{"objects_last"}.AddFlat(ids)...)
+	conn.Flush()
+	firstSeen, err := redis.Values(conn.Receive())
+	if err != nil {
+		return oj, err
+	}
+	lastSeen, err := redis.Values(conn.Receive())
+	if err != nil {
+		return oj, err
+	}
+	for i, id := range ids {
+		var first, last int64
+		if _, err := redis.Scan([]interface{}{firstSeen[i], lastSeen[i]}, &first, &last); err != nil {
+			return oj, err
+		}
+		oj.Objects = append(oj.Objects, ObjectJSON{ID: id, FirstSeen: time.Unix(first, 0).UTC(), LastSeen: time.Unix(last, 0).UTC()})
+	}
+	return oj, nil
+}
+
+type AuditJSON struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Object     string    `json:"object,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	KeyID      string    `json:"key_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+const auditLength = 1000
+
+// liveKeys are an object's lifetime counters.
+func liveKeys(objectID string) []string {
+	keys := []string{"hll_" + objectID, "hits_" + objectID}
+	for _, milestone := range depthMilestones {
+		keys = append(keys, depthKey(objectID, milestone))
+	}
+	return keys
+}
+
+// bucketKeys are the time buckets an object may still appear in: its daily
+// HyperLogLogs, and the leaderboards which rank it. Older ones have expired.
+func bucketKeys(site *Site, objectID string, now time.Time) (hllKeys, topKeys []string) {
+	seen := map[string]bool{}
+	for _, date := range days(now.Add(-time.Duration(site.periodTTL())*time.Second), now) {
+		hllKeys = append(hllKeys, dayHllKey(objectID, date))
+		t, _ := time.Parse(dateFormat, date)
+		for _, period := range periods {
+			start, _ := periodStart(period, t)
+			if key := topKey(period, start); !seen[key] {
+				seen[key] = true
+				topKeys = append(topKeys, key)
+			}
+		}
+	}
+	return hllKeys, topKeys
+}
+
+// ResetObject zeroes an object's live visits and uniques, keeping migrated
+// totals, time buckets and its place in the index.
+func ResetObject(site *Site, objectID string) error {
+	conn := site.Conn()
+	defer conn.Close()
+	_, err := conn.Do("DEL", redis.Args{}.AddFlat(liveKeys(objectID))...)
+	return err
+}
+
+// DeleteObject removes everything beacon stores about an object. Visitor
+// histories which mention it are left to expire.
+func DeleteObject(site *Site, objectID string) error {
+	conn := site.Conn()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	deleteObject(conn, site, objectID, time.Now())
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// deleteObject queues DeleteObject's commands, for a MULTI.
+func deleteObject(conn redis.Conn, site *Site, objectID string, now time.Time) {
+	keys := append(liveKeys(objectID), "visits_"+objectID, "uniques_"+objectID, rejectedKey(objectID), referralsKey(objectID), onlineKey(objectID))
+	hllKeys, topKeys := bucketKeys(site, objectID, now)
+	keys = append(keys, hllKeys...)
+
+	conn.Send("DEL", redis.Args{}.AddFlat(keys)...)
+	for _, key := range topKeys {
+		conn.Send("ZREM", key, objectID)
+	}
+	conn.Send("ZREM", "objects", objectID)
+	conn.Send("ZREM", onlineObjectsKey, objectID)
+	conn.Send("HDEL", "objects_first", objectID)
+	conn.Send("HDEL", "objects_last", objectID)
+}
+
+func recordAudit(conn redis.Conn, req *http.Request, action, objectID, detail string) error {
+	js, _ := json.Marshal(AuditJSON{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Object:     objectID,
+		Detail:     detail,
+		KeyID:      requestKeyID(req),
+		RemoteAddr: remoteAddr(req),
+	})
+	conn.Send("LPUSH", "audit", js)
+	conn.Send("LTRIM", "audit", 0, auditLength-1)
+	_, err := conn.Do("")
+	return err
+}
+
+func apiDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	objectID := mux.Vars(req)["objectID"]
+	if err := DeleteObject(siteFor(req), objectID); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "delete", objectID, ""); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiResetHandler(w http.ResponseWriter, req *http.Request) {
+	objectID := mux.Vars(req)["objectID"]
+	if err := ResetObject(siteFor(req), objectID); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "reset", objectID, ""); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRejectedHandler(w http.ResponseWriter, req *http.Request) {
+	response, err := GetRejected(siteFor(req), mux.Vars(req)["objectID"])
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetRejected counts an object's hits which were recorded but not counted as
+// visits, by reason.
+func GetRejected(site *Site, objectID string) (map[string]int64, error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	counts, err := stringMap(conn.Do("HGETALL", rejectedKey(objectID)))
+	if err != nil {
+		return nil, err
+	}
+	rejected := map[string]int64{}
+	for reason, count := range counts {
+		rejected[reason], _ = strconv.ParseInt(count, 10, 64)
+	}
+	return rejected, nil
+}
+
+func apiAuditHandler(w http.ResponseWriter, req *http.Request) {
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+
+	entries, err := redis.Strings(conn.Do("LRANGE", "audit", 0, auditLength-1))
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit := []AuditJSON{}
+	for _, entry := range entries {
+		var aj AuditJSON
+		if err := json.Unmarshal([]byte(entry), &aj); err == nil {
+			audit = append(audit, aj)
+		}
+	}
+
+	js, _ := json.MarshalIndent(audit, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,160 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Object index", func() {
+	first := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(2015, 3, 18, 0, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "post_1", User: "jelder", Time: first},
+			{Object: "post_2", User: "jelder", Time: first},
+			{Object: "post_3", User: "jelder", Time: first},
+			{Object: "page_1", User: "jelder", Time: first},
+			{Object: "post_1", User: "cmbt", Time: last},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+	})
+	AfterEach(resetRedis)
+
+	It("should record when objects were first and last seen", func() {
+		result, _ := GetObjects(DefaultSite, "post_1", "", 10)
+		Expect(result.Objects).To(Equal([]ObjectJSON{{ID: "post_1", FirstSeen: first, LastSeen: last}}))
+	})
+
+	It("should page through objects with a prefix", func() {
+		result, _ := GetObjects(DefaultSite, "post_", "", 2)
+		Expect(result.Objects).To(HaveLen(2))
+		Expect(result.Cursor).To(Equal("post_2"))
+
+		result, _ = GetObjects(DefaultSite, "post_", result.Cursor, 2)
+		Expect(result.Objects).To(HaveLen(1))
+		Expect(result.Objects[0].ID).To(Equal("post_3"))
+		Expect(result.Cursor).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Deleting and resetting objects", func() {
+	BeforeEach(func() {
+		trackSomeEvents()
+		SetMigrated(DefaultSite, "foo", TrackJSON{Visits: 100, Uniques: 30})
+	})
+	AfterEach(resetRedis)
+
+	It("should zero live counts on reset but keep history", func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		event := Event{Object: "foo", User: "jelder", Referrer: "www.google.com"}
+		event.Track(conn)
+		Expect(ResetObject(DefaultSite, "foo")).To(Succeed())
+		referrers, _ := GetReferrers(DefaultSite, "foo", 10)
+		Expect(referrers.Referrers).To(HaveLen(1))
+		result, _ := Get(DefaultSite, "foo")
+		Expect(result).To(Equal(TrackJSON{Visits: 100, Uniques: 30}))
+		top, _ := GetTop(DefaultSite, "day", time.Now(), 10, "foo")
+		Expect(top.Objects).To(HaveLen(1))
+	})
+
+	It("should remove every trace of a deleted object", func() {
+		Expect(DeleteObject(DefaultSite, "foo")).To(Succeed())
+		result, _ := Get(DefaultSite, "foo")
+		Expect(result).To(Equal(TrackJSON{}))
+		top, _ := GetTop(DefaultSite, "month", time.Now(), 10, "")
+		Expect(top.Objects).To(Equal([]TopObjectJSON{{ID: "bar", Visits: 20, Uniques: 2}}))
+		objects, _ := GetObjects(DefaultSite, "", "", 10)
+		Expect(objects.Objects).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Merging objects", func() {
+	BeforeEach(func() {
+		trackSomeEvents()
+		conn := RedisPool.Get()
+		defer conn.Close()
+		event := Event{Object: "foo", User: "skipper"}
+		event.Track(conn)
+		SetMigrated(DefaultSite, "foo", TrackJSON{Visits: 100, Uniques: 30})
+	})
+	AfterEach(resetRedis)
+
+	It("should sum visits and union uniques", func() {
+		Expect(MergeObject(DefaultSite, "foo", "bar", false)).To(Succeed())
+		result, _ := Get(DefaultSite, "bar")
+		Expect(result).To(Equal(TrackJSON{Visits: 141, Uniques: 33}))
+		result, _ = Get(DefaultSite, "foo")
+		Expect(result).To(Equal(TrackJSON{}))
+	})
+
+	It("should merge time buckets", func() {
+		MergeObject(DefaultSite, "foo", "bar", false)
+		top, _ := GetTop(DefaultSite, "day", time.Now(), 10, "")
+		Expect(top.Objects).To(Equal([]TopObjectJSON{{ID: "bar", Visits: 41, Uniques: 3}}))
+	})
+
+	It("should not lose hits which arrive during a merge", func() {
+		visits := func() int64 {
+			foo, _ := Get(DefaultSite, "foo")
+			bar, _ := Get(DefaultSite, "bar")
+			return foo.Visits + bar.Visits
+		}
+		before := visits()
+		done := make(chan bool)
+		go func() {
+			conn := RedisPool.Get()
+			defer conn.Close()
+			for i := 0; i < 200; i++ {
+				event := Event{Object: "foo", User: "jelder"}
+				event.Track(conn)
+			}
+			done <- true
+		}()
+		for i := 0; i < 5; i++ {
+			Expect(MergeObject(DefaultSite, "foo", "bar", false)).To(Succeed())
+		}
+		<-done
+		Expect(visits()).To(Equal(before + 200))
+	})
+
+	It("should merge referrers", func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for _, event := range []Event{
+			{Object: "foo", User: "jelder", Referrer: "news.ycombinator.com"},
+			{Object: "bar", User: "jelder", Referrer: "news.ycombinator.com"},
+			{Object: "bar", User: "jelder", Referrer: "www.google.com"},
+		} {
+			event.Track(conn)
+		}
+		MergeObject(DefaultSite, "foo", "bar", false)
+		result, _ := GetReferrers(DefaultSite, "bar", 10)
+		Expect(result.Referrers).To(Equal([]ReferrerJSON{
+			{Host: "news.ycombinator.com", Visits: 2},
+			{Host: "www.google.com", Visits: 1},
+		}))
+		result, _ = GetReferrers(DefaultSite, "foo", 10)
+		Expect(result.Referrers).To(BeEmpty())
+	})
+
+	It("should record future hits under an alias", func() {
+		MergeObject(DefaultSite, "foo", "bar", true)
+		MergeObject(DefaultSite, "bar", "baz", true)
+		conn := RedisPool.Get()
+		defer conn.Close()
+		event := Event{Object: "foo", User: "jelder"}
+		event.Track(conn)
+		result, _ := Get(DefaultSite, "baz")
+		Expect(result.Visits).To(Equal(int64(142)))
+		result, _ = Get(DefaultSite, "foo")
+		Expect(result.Visits).To(Equal(int64(0)))
+	})
+})
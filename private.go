@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultShareTTL = 60 * 60 * 24 * 7
+
+type ShareJSON struct {
+	Object  string    `json:"object"`
+	TTL     int64     `json:"ttl,omitempty"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (share *ShareJSON) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&share.Object: binding.Field{Form: "object", Required: true},
+		&share.TTL:    "ttl",
+	}
+}
+
+type PrivateJSON struct {
+	Pattern string `json:"pattern"`
+}
+
+func (private *PrivateJSON) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&private.Pattern: binding.Field{Form: "pattern", Required: true},
+	}
+}
+
+// Private patterns are object IDs, or prefixes ending in *.
+func matchesPattern(pattern, objectID string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(objectID, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == objectID
+}
+
+func privatePatterns(conn redis.Conn) ([]string, error) {
+	return redis.Strings(conn.Do("SMEMBERS", "private"))
+}
+
+func isPrivate(patterns []string, objectID string) bool {
+	for _, pattern := range patterns {
+		if matchesPattern(pattern, objectID) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollupGroups are the groups a hit on objectID counts towards. A private
+// object's hits are kept out of public groups, whose counts would give them
+// away.
+func rollupGroups(patterns []string, objectID string) []string {
+	groups := ancestors(objectID)
+	if len(groups) == 0 || !isPrivate(patterns, objectID) {
+		return groups
+	}
+	private := []string{}
+	for _, group := range groups {
+		if isPrivate(patterns, group) {
+			private = append(private, group)
+		}
+	}
+	return private
+}
+
+// ShareToken lets anyone holding it read a private object until it expires.
+func ShareToken(site *Site, objectID string, expires time.Time) string {
+	return signedToken("share", site.prefix()+objectID, expires)
+}
+
+// canReadAll reports whether the request carries a key with the read scope,
+// which can read every object.
+func canReadAll(req *http.Request) (bool, error) {
+	key, err := lookupAPIKey(req)
+	return key != nil && key.Allows("read"), err
+}
+
+// publicObjects filters out the private objects among ids, unless the request
+// can read everything.
+func publicObjects(req *http.Request, ids []string) ([]string, error) {
+	if ok, err := canReadAll(req); ok || err != nil {
+		return ids, err
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	patterns, err := privatePatterns(conn)
+	if err != nil {
+		return nil, err
+	}
+	public := []string{}
+	for _, id := range ids {
+		if !isPrivate(patterns, id) {
+			public = append(public, id)
+		}
+	}
+	return public, nil
+}
+
+// requireReadable guards the per-object read APIs. Public objects can be read
+// anonymously; private ones need a read key, or a share token for that object
+// in the token parameter.
+func requireReadable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		objectID := mux.Vars(req)["objectID"]
+		public, err := publicObjects(req, []string{objectID})
+		if err != nil {
+			fmt.Print(err)
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(public) == 0 && !validToken("share", siteFor(req).prefix()+objectID, req.URL.Query().Get("token"), time.Now()) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="beacon"`)
+			jsonError(w, "This object is private; pass a read key or a share token", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+func apiPrivateHandler(w http.ResponseWriter, req *http.Request) {
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+
+	patterns, err := privatePatterns(conn)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(patterns)
+
+	js, _ := json.MarshalIndent(patterns, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiPrivateWriteHandler(w http.ResponseWriter, req *http.Request) {
+	private := new(PrivateJSON)
+	if !bind(w, req, private) {
+		return
+	}
+	if err := SetPrivate(siteFor(req), private.Pattern, true); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "make_private", "", private.Pattern); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiPrivateDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	pattern := req.URL.Query().Get("pattern")
+	if pattern == "" {
+		jsonError(w, "Must pass pattern parameter", http.StatusBadRequest)
+		return
+	}
+	if err := SetPrivate(siteFor(req), pattern, false); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "make_public", "", pattern); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetPrivate marks the objects matching pattern as private, or public again.
+func SetPrivate(site *Site, pattern string, private bool) error {
+	conn := site.Conn()
+	defer conn.Close()
+	command := "SREM"
+	if private {
+		command = "SADD"
+	}
+	_, err := conn.Do(command, "private", pattern)
+	siteDefinitions.forget(site)
+	return err
+}
+
+func apiShareHandler(w http.ResponseWriter, req *http.Request) {
+	if ENV["SECRET_KEY"] == "" {
+		jsonError(w, "Share tokens need SECRET_KEY to be set", http.StatusNotImplemented)
+		return
+	}
+	share := new(ShareJSON)
+	if !bind(w, req, share) {
+		return
+	}
+	if share.TTL <= 0 {
+		share.TTL = defaultShareTTL
+	}
+	share.Expires = time.Now().Add(time.Duration(share.TTL) * time.Second).UTC().Truncate(time.Second)
+	share.Token = ShareToken(siteFor(req), share.Object, share.Expires)
+
+	js, _ := json.MarshalIndent(share, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
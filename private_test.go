@@ -0,0 +1,65 @@
+package main_test
+
+import (
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("Private objects", func() {
+	var readKey APIKey
+
+	BeforeEach(func() {
+		ENV["SECRET_KEY"] = "sekrit"
+		trackSomeEvents()
+		SetPrivate(DefaultSite, "fo*", true)
+		readKey, _ = CreateAPIKey(DefaultSite, "dashboard", "read")
+	})
+	AfterEach(func() {
+		delete(ENV, "SECRET_KEY")
+		resetRedis()
+	})
+
+	It("should keep public objects anonymous", func() {
+		w := request("GET", "/api/v1/bar", "", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+	})
+
+	It("should require a read key for private objects", func() {
+		w := request("GET", "/api/v1/foo", "", "")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		w = request("GET", "/api/v1/_multi?id=foo,bar", "", "")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		w = authorizedRequest("GET", "/api/v1/foo", readKey.Key, "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+	})
+
+	It("should accept an unexpired share token for that object", func() {
+		token := ShareToken(DefaultSite, "foo", time.Now().Add(time.Hour))
+		w := request("GET", "/api/v1/foo?token="+token, "", "")
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		w = request("GET", "/api/v1/foo2?token="+token, "", "")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+		expired := ShareToken(DefaultSite, "foo", time.Now().Add(-time.Hour))
+		w = request("GET", "/api/v1/foo?token="+expired, "", "")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should leave private objects out of listings", func() {
+		w := request("GET", "/api/v1/_top", "", "")
+		var top TopJSON
+		json.Unmarshal(w.Body.Bytes(), &top)
+		Expect(top.Objects).To(HaveLen(1))
+		Expect(top.Objects[0].ID).To(Equal("bar"))
+
+		w = authorizedRequest("GET", "/api/v1/_objects", readKey.Key, "")
+		var objects ObjectsJSON
+		json.Unmarshal(w.Body.Bytes(), &objects)
+		Expect(objects.Objects).To(HaveLen(2))
+	})
+})
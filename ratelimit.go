@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var rateLimitScript = redis.NewScript(1, fmt.Sprintf("%s", mustReadFile("assets/ratelimit.lua")))
+
+func rateLimitKey(group, client string) string {
+	return "ratelimit_" + group + "_" + client
+}
+
+// rateLimitClients names the buckets a request draws from. Without a uid
+// cookie a client is known by its ip, whatever RATE_LIMIT_BY says.
+func rateLimitClients(req *http.Request) (clients []string) {
+	by := rateLimitBy()
+	if by != "ip" {
+		if cookie, err := req.Cookie("uid"); err == nil && cookie.Value != "" {
+			clients = append(clients, "uid:"+cookie.Value)
+		}
+	}
+	if by != "uid" || len(clients) == 0 {
+		clients = append(clients, "ip:"+remoteAddr(req))
+	}
+	return clients
+}
+
+// takeToken spends a token from each of a request's buckets in group. When
+// any is empty the request is refused, and wait is how long until it refills.
+func takeToken(conn redis.Conn, group string, req *http.Request, now time.Time) (allowed bool, wait time.Duration, err error) {
+	requests, per, ok := rateLimitConfig(group)
+	if !ok {
+		return true, 0, nil
+	}
+	interval := float64(per/time.Millisecond) / float64(requests)
+	ms := now.UnixNano() / int64(time.Millisecond)
+
+	allowed = true
+	for _, client := range rateLimitClients(req) {
+		reply, err := redis.Values(rateLimitScript.Do(conn, rateLimitKey(group, client), requests, strconv.FormatFloat(interval, 'f', -1, 64), ms))
+		if err != nil {
+			return true, 0, err
+		}
+		var ok, retry int64
+		if _, err := redis.Scan(reply, &ok, &retry); err != nil {
+			return true, 0, err
+		}
+		if ok == 0 {
+			allowed = false
+			if d := time.Duration(retry) * time.Millisecond; d > wait {
+				wait = d
+			}
+		}
+	}
+	return allowed, wait, nil
+}
+
+// rateLimited refuses requests from clients which have used up group's limit
+// with a 429. Should Redis fail, requests are let through rather than lost.
+func rateLimited(group string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := rateLimitConfig(group); !ok {
+			h(w, req)
+			return
+		}
+		conn := RedisPool.Get()
+		allowed, wait, err := takeToken(conn, group, req, time.Now())
+		conn.Close()
+		if err != nil {
+			fmt.Print(err)
+		}
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if group == "pixel" {
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			} else {
+				jsonError(w, "Too many requests", http.StatusTooManyRequests)
+			}
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,87 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+func requestFrom(ip, method, url string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("X-Forwarded-For", ip)
+	w := httptest.NewRecorder()
+	Router().ServeHTTP(w, req)
+	return w
+}
+
+var _ = Describe("Rate limiting", func() {
+	BeforeEach(func() {
+		ENV["API_RATE_LIMIT"] = "2/60"
+	})
+	AfterEach(func() {
+		delete(ENV, "API_RATE_LIMIT")
+		resetRedis()
+	})
+
+	It("should refuse a client over its limit", func() {
+		Expect(requestFrom("10.0.0.1", "GET", "/api/v1/foo").Code).To(Equal(http.StatusOK))
+		Expect(requestFrom("10.0.0.1", "GET", "/api/v1/bar").Code).To(Equal(http.StatusOK))
+		w := requestFrom("10.0.0.1", "GET", "/api/v1/foo")
+		Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(w.Header().Get("Retry-After")).To(Equal("30"))
+	})
+
+	It("should keep separate buckets per client", func() {
+		requestFrom("10.0.0.1", "GET", "/api/v1/foo")
+		requestFrom("10.0.0.1", "GET", "/api/v1/foo")
+		Expect(requestFrom("10.0.0.2", "GET", "/api/v1/foo").Code).To(Equal(http.StatusOK))
+	})
+
+	It("should ignore addresses the client put in X-Forwarded-For", func() {
+		requestFrom("10.0.0.1", "GET", "/api/v1/foo")
+		requestFrom("10.0.0.1", "GET", "/api/v1/foo")
+		w := requestFrom("1.2.3.4, 10.0.0.1", "GET", "/api/v1/foo")
+		Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("should not limit pixels with the API limit", func() {
+		for i := 0; i < 3; i++ {
+			requestFrom("10.0.0.1", "GET", "/api/v1/foo")
+		}
+		ENV["PIXEL_RATE_LIMIT"] = "1/60"
+		defer delete(ENV, "PIXEL_RATE_LIMIT")
+		// An invalid depth keeps the hit out of the tracker
+		Expect(requestFrom("10.0.0.1", "GET", "/foo.png?depth=7").Code).To(Equal(http.StatusBadRequest))
+		Expect(requestFrom("10.0.0.1", "GET", "/foo.png?depth=7").Code).To(Equal(http.StatusTooManyRequests))
+	})
+})
+
+var _ = Describe("Dedup", func() {
+	AfterEach(resetRedis)
+
+	visits := func() int64 {
+		result, _ := Get(DefaultSite, "foo")
+		return result.Visits
+	}
+
+	It("should count one visit per uid within the window", func() {
+		SetDedupWindow(DefaultSite, "fo*", 1800)
+		trackSomeEvents()
+		Expect(visits()).To(Equal(int64(2)))
+		rejected, _ := GetRejected(DefaultSite, "foo")
+		Expect(rejected["duplicate_hits"]).To(Equal(int64(18)))
+
+		result, _ := Get(DefaultSite, "bar")
+		Expect(result.Visits).To(Equal(int64(20)))
+	})
+
+	It("should list and remove windows", func() {
+		SetDedupWindow(DefaultSite, "f*", 1800)
+		SetDedupWindow(DefaultSite, "foo", 0)
+		SetDedupWindow(DefaultSite, "fo*", 60)
+		windows, _ := GetDedupWindows(DefaultSite)
+		Expect(windows).To(Equal(map[string]int64{"f*": 1800, "fo*": 60}))
+	})
+})
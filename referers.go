@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/mholt/binding"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type RefererJSON struct {
+	Domain string `json:"domain"`
+}
+
+func (referer *RefererJSON) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&referer.Domain: binding.Field{Form: "domain", Required: true},
+	}
+}
+
+func (referer *RefererJSON) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	referer.Domain = normalizeDomain(referer.Domain)
+	if referer.Domain == "" || strings.ContainsAny(referer.Domain, "/:* ") {
+		errs.Add([]string{"domain"}, "ComplexError", "domain must be a host name like example.com")
+	}
+	return errs
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// allowsHost reports whether host is one of domains or a subdomain of one.
+func allowsHost(domains []string, host string) bool {
+	host = normalizeDomain(host)
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestingHost is the host of the page which embedded the tracking image,
+// from its Referer or else its Origin. Browsers may send neither.
+func requestingHost(req *http.Request) string {
+	for _, header := range []string{"Referer", "Origin"} {
+		if value := req.Header.Get(header); value != "" {
+			if u, err := url.Parse(value); err == nil && u.Host != "" {
+				return hostname(u.Host)
+			}
+		}
+	}
+	return ""
+}
+
+// isForeignHit reports whether a hit comes from a page outside its site's
+// referer allow-list. Sites without one accept hits from anywhere. Hits which
+// don't say where they are from are foreign unless allowMissingReferer.
+func isForeignHit(req *http.Request) (bool, error) {
+	host := requestingHost(req)
+	if host == "" && allowMissingReferer() {
+		return false, nil
+	}
+	site := siteFor(req)
+	conn := site.Conn()
+	defer conn.Close()
+	defs, err := siteDefinitions.get(site, conn)
+	if err != nil || len(defs.referers) == 0 {
+		return false, err
+	}
+	return host == "" || !allowsHost(defs.referers, host), nil
+}
+
+// SetReferer adds domain, and its subdomains, to the site's referer
+// allow-list, or removes it.
+func SetReferer(site *Site, domain string, allowed bool) error {
+	conn := site.Conn()
+	defer conn.Close()
+	command := "SREM"
+	if allowed {
+		command = "SADD"
+	}
+	_, err := conn.Do(command, "referers", normalizeDomain(domain))
+	siteDefinitions.forget(site)
+	return err
+}
+
+func apiReferersHandler(w http.ResponseWriter, req *http.Request) {
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+
+	domains, err := redis.Strings(conn.Do("SMEMBERS", "referers"))
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(domains)
+
+	js, _ := json.MarshalIndent(domains, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiRefererWriteHandler(w http.ResponseWriter, req *http.Request) {
+	referer := new(RefererJSON)
+	if !bind(w, req, referer) {
+		return
+	}
+	if err := SetReferer(siteFor(req), referer.Domain, true); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "allow_referer", "", referer.Domain); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRefererDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	domain := req.URL.Query().Get("domain")
+	if domain == "" {
+		jsonError(w, "Must pass domain parameter", http.StatusBadRequest)
+		return
+	}
+	if err := SetReferer(siteFor(req), domain, false); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := siteFor(req).Conn()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "disallow_referer", "", normalizeDomain(domain)); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
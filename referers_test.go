@@ -0,0 +1,96 @@
+package main_test
+
+import (
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+func embeddedRequest(url, referer string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	w := httptest.NewRecorder()
+	Router().ServeHTTP(w, req)
+	return w
+}
+
+var _ = Describe("Referer allow-list", func() {
+	BeforeEach(func() {
+		startTracker.Do(func() { go Tracker() })
+		SetReferer(DefaultSite, "Example.com", true)
+	})
+	AfterEach(resetRedis)
+
+	visits := func() int64 {
+		result, _ := Get(DefaultSite, "foo")
+		return result.Visits
+	}
+	foreign := func() int64 {
+		rejected, _ := GetRejected(DefaultSite, "foo")
+		return rejected["foreign_hits"]
+	}
+
+	It("should count hits from allowed domains and their subdomains", func() {
+		embeddedRequest("/foo.png", "https://example.com/post")
+		embeddedRequest("/foo.png", "https://blog.example.com:8080/post")
+		Eventually(visits).Should(Equal(int64(2)))
+		Expect(foreign()).To(Equal(int64(0)))
+	})
+
+	It("should only accept hits without a Referer when asked to", func() {
+		embeddedRequest("/foo.png", "")
+		Eventually(foreign).Should(Equal(int64(1)))
+
+		ENV["ALLOW_MISSING_REFERER"] = "true"
+		defer delete(ENV, "ALLOW_MISSING_REFERER")
+		embeddedRequest("/foo.png", "")
+		Eventually(visits).Should(Equal(int64(1)))
+		Expect(foreign()).To(Equal(int64(1)))
+	})
+
+	It("should count hits from other domains separately", func() {
+		embeddedRequest("/foo.png", "https://notexample.com/")
+		embeddedRequest("/foo.png", "https://example.com/")
+		Eventually(visits).Should(Equal(int64(1)))
+		Eventually(foreign).Should(Equal(int64(1)))
+	})
+
+	It("should reject hits from other domains when asked to", func() {
+		ENV["FOREIGN_HITS"] = "reject"
+		defer delete(ENV, "FOREIGN_HITS")
+		Expect(embeddedRequest("/foo.png", "https://evil.com/").Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should reject unsigned hits from other domains when asked to", func() {
+		ENV["PIXEL_SIGNING_KEY"] = "sekrit"
+		ENV["PIXEL_SIGNING"] = "count"
+		ENV["FOREIGN_HITS"] = "reject"
+		defer func() {
+			delete(ENV, "PIXEL_SIGNING_KEY")
+			delete(ENV, "PIXEL_SIGNING")
+			delete(ENV, "FOREIGN_HITS")
+		}()
+		Expect(embeddedRequest("/foo.png", "https://evil.com/").Code).To(Equal(http.StatusForbidden))
+		Expect(embeddedRequest("/foo.png", "https://example.com/").Code).To(Equal(http.StatusOK))
+	})
+
+	It("should be managed through the admin API", func() {
+		ENV["SECRET_KEY"] = "sekrit"
+		defer delete(ENV, "SECRET_KEY")
+
+		w := authorizedRequest("POST", "/api/v1/_referers", "sekrit", `{"domain": "acme.com"}`)
+		Expect(w.Code).To(Equal(http.StatusNoContent))
+		w = authorizedRequest("DELETE", "/api/v1/_referers?domain=example.com", "sekrit", "")
+		Expect(w.Code).To(Equal(http.StatusNoContent))
+
+		var domains []string
+		w = authorizedRequest("GET", "/api/v1/_referers", "sekrit", "")
+		json.Unmarshal(w.Body.Bytes(), &domains)
+		Expect(domains).To(Equal([]string{"acme.com"}))
+	})
+})
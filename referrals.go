@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const defaultReferrersLimit = 10
+
+type ReferrerJSON struct {
+	Host   string `json:"host"`
+	Visits int64  `json:"visits"`
+}
+
+type ReferrersJSON struct {
+	Referrers []ReferrerJSON `json:"referrers"`
+}
+
+func referralsKey(objectID string) string {
+	return "referrals_" + objectID
+}
+
+// referrer is the host of the page a visitor came from, which the tracked page
+// passes as ref (its document.referrer). The request's own Referer is the
+// tracked page itself, so links within it aren't counted.
+func referrer(req *http.Request) string {
+	u, err := url.Parse(req.URL.Query().Get("ref"))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := normalizeDomain(hostname(u.Host))
+	if host == normalizeDomain(requestingHost(req)) {
+		return ""
+	}
+	return host
+}
+
+func apiReferrersHandler(w http.ResponseWriter, req *http.Request) {
+	limit := defaultReferrersLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxTopLimit {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, err := GetReferrers(siteFor(req), mux.Vars(req)["objectID"], limit)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetReferrers ranks the hosts which sent an object the most visits.
+func GetReferrers(site *Site, objectID string, limit int) (rj ReferrersJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	ranked, err := redis.Values(conn.Do("ZREVRANGE", referralsKey(objectID), 0, limit-1, "WITHSCORES"))
+	if err != nil {
+		return rj, err
+	}
+	rj.Referrers = []ReferrerJSON{}
+	for len(ranked) > 0 {
+		var referrer ReferrerJSON
+		if ranked, err = redis.Scan(ranked, &referrer.Host, &referrer.Visits); err != nil {
+			return rj, err
+		}
+		rj.Referrers = append(rj.Referrers, referrer)
+	}
+	return rj, nil
+}
@@ -0,0 +1,46 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/url"
+)
+
+var _ = Describe("Referrers", func() {
+	BeforeEach(func() {
+		startTracker.Do(func() { go Tracker() })
+	})
+	AfterEach(resetRedis)
+
+	hit := func(ref string) {
+		embeddedRequest("/blog_post.png?ref="+url.QueryEscape(ref), "https://example.com/blog/post")
+	}
+	visits := func() int64 {
+		result, _ := Get(DefaultSite, "blog_post")
+		return result.Visits
+	}
+
+	It("should rank the hosts visitors came from", func() {
+		hit("https://news.ycombinator.com/item?id=1")
+		hit("https://news.ycombinator.com/item?id=2")
+		hit("https://www.google.com/")
+		Eventually(visits).Should(Equal(int64(3)))
+
+		result, err := GetReferrers(DefaultSite, "blog_post", 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Referrers).To(Equal([]ReferrerJSON{
+			{Host: "news.ycombinator.com", Visits: 2},
+			{Host: "www.google.com", Visits: 1},
+		}))
+	})
+
+	It("should ignore links from the page's own host", func() {
+		hit("https://example.com/")
+		hit("")
+		Eventually(visits).Should(Equal(int64(2)))
+
+		result, _ := GetReferrers(DefaultSite, "blog_post", 10)
+		Expect(result.Referrers).To(BeEmpty())
+	})
+})
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetentionWeeks = 8
+	maxRetentionWeeks     = 52
+
+	// A visitor's first week is remembered for as long as a report can look
+	// back; returning after that, they start a new cohort
+	firstWeekTTL = (maxRetentionWeeks + 1) * 7 * 24 * 60 * 60
+)
+
+type CohortJSON struct {
+	Week     string    `json:"week"`
+	Visitors int64     `json:"visitors"`
+	Retained []int64   `json:"retained"`
+	Rates    []float64 `json:"rates"`
+}
+
+type RetentionJSON struct {
+	Backend string       `json:"backend"`
+	Cohorts []CohortJSON `json:"cohorts"`
+}
+
+// Cohorts and weekly actives are HyperLogLogs by default, which keeps them
+// small at the cost of approximate intersections. RETENTION_BACKEND=sets
+// stores every uid in exact sets instead, and needs Redis 7 for SINTERCARD.
+func retentionBackend() string {
+	if ENV["RETENTION_BACKEND"] == "sets" {
+		return "sets"
+	}
+	return "hll"
+}
+
+// week returns the Monday starting the week containing t.
+func week(t time.Time) time.Time {
+	t = t.UTC().Truncate(24 * time.Hour)
+	return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+}
+
+func firstWeekKey(user string) string {
+	return "firstweek_" + user
+}
+
+func cohortKey(week string) string {
+	return "cohort_" + week
+}
+
+func activeKey(week string) string {
+	return "active_" + week
+}
+
+// claimFirstWeek claims the visitor's first week outside the MULTI, since the
+// answer decides what gets queued in it. The reply is nil unless the visitor
+// is new.
+func claimFirstWeek(conn redis.Conn, event *Event) {
+	conn.Send("SET", firstWeekKey(event.User), day(week(event.time())), "EX", firstWeekTTL, "NX")
+}
+
+func trackRetention(conn redis.Conn, event *Event, newVisitor bool) {
+	add := "PFADD"
+	if retentionBackend() == "sets" {
+		add = "SADD"
+	}
+	thisWeek := day(week(event.time()))
+	if newVisitor {
+		conn.Send(add, cohortKey(thisWeek), event.User)
+	}
+	conn.Send(add, activeKey(thisWeek), event.User)
+}
+
+func apiRetentionHandler(w http.ResponseWriter, req *http.Request) {
+	weeks := defaultRetentionWeeks
+	if s := req.URL.Query().Get("weeks"); s != "" {
+		var err error
+		if weeks, err = strconv.Atoi(s); err != nil || weeks < 1 || weeks > maxRetentionWeeks {
+			jsonError(w, fmt.Sprintf("weeks must be between 1 and %d", maxRetentionWeeks), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, err := GetRetention(siteFor(req), time.Now(), weeks)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetRetention returns the retention matrix for the given number of weekly
+// cohorts up to and including the week of now. Retained[k] counts the members
+// of a cohort who were active k weeks after their first visit.
+func GetRetention(site *Site, now time.Time, weeks int) (rj RetentionJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	rj.Backend = retentionBackend()
+	sets := rj.Backend == "sets"
+	thisWeek := week(now)
+	cohortWeeks := make([]string, weeks)
+	for i := range cohortWeeks {
+		cohortWeeks[i] = day(thisWeek.AddDate(0, 0, -7*(weeks-1-i)))
+	}
+
+	// Every count is queued before any is read, so the whole matrix takes one
+	// round trip. The cohort's week i+k is k weeks after cohort i.
+	count := "PFCOUNT"
+	if sets {
+		count = "SCARD"
+	}
+	for _, w := range cohortWeeks {
+		conn.Send(count, cohortKey(w))
+	}
+	if !sets {
+		for _, w := range cohortWeeks {
+			conn.Send("PFCOUNT", activeKey(w))
+		}
+	}
+	for i := range cohortWeeks {
+		for j := i + 1; j < weeks; j++ {
+			if sets {
+				conn.Send("SINTERCARD", 2, cohortKey(cohortWeeks[i]), activeKey(cohortWeeks[j]))
+			} else {
+				conn.Send("PFCOUNT", cohortKey(cohortWeeks[i]), activeKey(cohortWeeks[j]))
+			}
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return rj, err
+	}
+	queued := weeks + weeks*(weeks-1)/2
+	if !sets {
+		queued += weeks
+	}
+	counts, err := receiveCounts(conn, queued)
+	if err != nil {
+		return rj, err
+	}
+	cohorts, counts := counts[:weeks], counts[weeks:]
+	var actives []int64
+	if !sets {
+		actives, counts = counts[:weeks], counts[weeks:]
+	}
+
+	for i, w := range cohortWeeks {
+		cj := CohortJSON{Week: w, Visitors: cohorts[i]}
+		for j := i; j < weeks; j++ {
+			retained := cj.Visitors
+			if j > i {
+				retained, counts = counts[0], counts[1:]
+				if !sets {
+					retained = intersection(cohorts[i], actives[j], retained)
+				}
+			}
+			rate := 0.0
+			if cj.Visitors > 0 {
+				rate = float64(retained) / float64(cj.Visitors)
+			}
+			cj.Retained = append(cj.Retained, retained)
+			cj.Rates = append(cj.Rates, rate)
+		}
+		rj.Cohorts = append(rj.Cohorts, cj)
+	}
+	return rj, nil
+}
+
+// receiveCounts reads n integer replies. Every one is read, even after an
+// error, so none is left to be mistaken for the reply to a later command.
+func receiveCounts(conn redis.Conn, n int) (counts []int64, err error) {
+	counts = make([]int64, n)
+	for i := range counts {
+		count, replyErr := redis.Int64(conn.Receive())
+		if replyErr != nil && err == nil {
+			err = replyErr
+		}
+		counts[i] = count
+	}
+	return counts, err
+}
+
+// intersection estimates how many of a cohort were active in a later week.
+// HyperLogLogs can't be intersected directly, so use |A ∩ B| = |A| + |B| -
+// |A ∪ B|, clamped to what is actually possible.
+func intersection(cohort, active, union int64) int64 {
+	retained := cohort + active - union
+	if retained < 0 {
+		retained = 0
+	}
+	if retained > cohort {
+		retained = cohort
+	}
+	if retained > active {
+		retained = active
+	}
+	return retained
+}
@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Retention", func() {
+	var result RetentionJSON
+	now := time.Date(2015, 3, 18, 12, 0, 0, 0, time.UTC)
+	lastWeek := now.AddDate(0, 0, -7)
+
+	BeforeEach(func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		events := []Event{
+			{Object: "foo", User: "jelder", Time: lastWeek},
+			{Object: "foo", User: "cmbt", Time: lastWeek},
+			{Object: "foo", User: "jelder", Time: now},
+			{Object: "foo", User: "skipper", Time: now},
+		}
+		for _, event := range events {
+			event.Track(conn)
+		}
+		result, _ = GetRetention(DefaultSite, now, 2)
+	})
+	AfterEach(resetRedis)
+
+	It("should group visitors by the Monday of their first week", func() {
+		Expect(result.Cohorts).To(HaveLen(2))
+		Expect(result.Cohorts[0].Week).To(Equal("2015-03-09"))
+		Expect(result.Cohorts[1].Week).To(Equal("2015-03-16"))
+		Expect(result.Cohorts[1].Visitors).To(Equal(int64(1)))
+	})
+
+	It("should count returning visitors in later weeks", func() {
+		Expect(result.Cohorts[0].Retained).To(Equal([]int64{2, 1}))
+		Expect(result.Cohorts[0].Rates).To(Equal([]float64{1, 0.5}))
+	})
+	It("should count the same with exact sets", func() {
+		ENV["RETENTION_BACKEND"] = "sets"
+		defer delete(ENV, "RETENTION_BACKEND")
+		resetRedis()
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for _, event := range []Event{
+			{Object: "foo", User: "jelder", Time: lastWeek},
+			{Object: "foo", User: "cmbt", Time: lastWeek},
+			{Object: "foo", User: "jelder", Time: now},
+			{Object: "foo", User: "skipper", Time: now},
+		} {
+			event.Track(conn)
+		}
+		result, err := GetRetention(DefaultSite, now, 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Cohorts).To(HaveLen(3))
+		Expect(result.Cohorts[1].Retained).To(Equal([]int64{2, 1}))
+		Expect(result.Cohorts[2].Retained).To(Equal([]int64{1}))
+	})
+
+	It("should forget first weeks after a year", func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		ttl, _ := redis.Int(conn.Do("TTL", "firstweek_jelder"))
+		Expect(ttl).To(BeNumerically(">", 52*7*24*60*60))
+		Expect(ttl).To(BeNumerically("<=", 53*7*24*60*60))
+	})
+})
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+type DayJSON struct {
+	Date    string `json:"date"`
+	Visits  int64  `json:"visits"`
+	Uniques int64  `json:"uniques"`
+}
+
+type SeriesJSON struct {
+	Visits  int64     `json:"visits"`
+	Uniques int64     `json:"uniques"`
+	Days    []DayJSON `json:"days"`
+}
+
+func apiSeriesHandler(w http.ResponseWriter, req *http.Request) {
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := GetSeries(siteFor(req), mux.Vars(req)["objectID"], from, to)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetSeries returns an object's visits and uniques for each day from from
+// through to, read from the daily leaderboards and HyperLogLogs, so only as
+// far back as the site keeps them. Uniques over the whole range are counted
+// once each.
+func GetSeries(site *Site, objectID string, from, to time.Time) (sj SeriesJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	dates := days(from, to)
+	hllKeys := []string{}
+	for _, date := range dates {
+		t, _ := time.Parse(dateFormat, date)
+		conn.Send("ZSCORE", topKey("day", t), objectID)
+		conn.Send("PFCOUNT", dayHllKey(objectID, date))
+		hllKeys = append(hllKeys, dayHllKey(objectID, date))
+	}
+	conn.Send("PFCOUNT", redis.Args{}.AddFlat(hllKeys)...)
+	conn.Flush()
+
+	sj.Days = []DayJSON{}
+	for _, date := range dates {
+		dj := DayJSON{Date: date}
+		if dj.Visits, err = redis.Int64(conn.Receive()); err != nil && err != redis.ErrNil {
+			return sj, err
+		}
+		if dj.Uniques, err = redis.Int64(conn.Receive()); err != nil {
+			return sj, err
+		}
+		sj.Visits += dj.Visits
+		sj.Days = append(sj.Days, dj)
+	}
+	sj.Uniques, err = redis.Int64(conn.Receive())
+	return sj, err
+}
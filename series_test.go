@@ -0,0 +1,44 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Daily series", func() {
+	now := time.Date(2015, 3, 18, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for _, event := range []Event{
+			{Object: "post_1", User: "jelder", Time: now.AddDate(0, 0, -2)},
+			{Object: "post_1", User: "jelder", Time: now},
+			{Object: "post_1", User: "cmbt", Time: now},
+			{Object: "post_1", User: "cmbt", Time: now},
+			{Object: "post_2", User: "jelder", Time: now},
+		} {
+			event.Track(conn)
+		}
+	})
+	AfterEach(resetRedis)
+
+	It("should count each day's visits and uniques", func() {
+		result, err := GetSeries(DefaultSite, "post_1", now.AddDate(0, 0, -2), now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Days).To(Equal([]DayJSON{
+			{Date: "2015-03-16", Visits: 1, Uniques: 1},
+			{Date: "2015-03-17", Visits: 0, Uniques: 0},
+			{Date: "2015-03-18", Visits: 3, Uniques: 2},
+		}))
+		Expect(result.Visits).To(Equal(int64(4)))
+		Expect(result.Uniques).To(Equal(int64(2)))
+	})
+
+	It("should validate the date range", func() {
+		w := request("GET", "/api/v1/post_1/series?from=2015-03-18&to=2015-03-01", "", "")
+		Expect(w.Code).To(Equal(400))
+	})
+})
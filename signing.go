@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mholt/binding"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SignJSON struct {
+	Object  string `json:"object"`
+	TTL     int64  `json:"ttl,omitempty"`
+	URL     string `json:"url"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func (sign *SignJSON) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&sign.Object: binding.Field{Form: "object", Required: true},
+		&sign.TTL:    "ttl",
+	}
+}
+
+// signature is an HMAC-SHA256 of parts, keyed with key.
+func signature(key string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedToken binds purpose and subject to an expiry, returning
+// "<expiry>.<signature>". A zero expires never expires.
+func signedToken(purpose, subject string, expires time.Time) string {
+	expiry := "0"
+	if !expires.IsZero() {
+		expiry = strconv.FormatInt(expires.Unix(), 10)
+	}
+	return expiry + "." + signature(signingKey(purpose), purpose, subject, expiry)
+}
+
+func validToken(purpose, subject, token string, now time.Time) bool {
+	if signingKey(purpose) == "" {
+		return false
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || (expiry != 0 && now.Unix() > expiry) {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(signature(signingKey(purpose), purpose, subject, parts[0])))
+}
+
+// SignPixel returns the path of a signed tracking image for objectID. With a
+// ttl in seconds the signature expires; otherwise it is good forever.
+func SignPixel(site *Site, objectID string, ttl int64) (path string, expires time.Time) {
+	if ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	sig := signedToken("pixel", site.prefix()+objectID, expires)
+	return site.path("/"+objectID+".png") + "?sig=" + url.QueryEscape(sig), expires
+}
+
+func pixelURL(path string) string {
+	return strings.TrimSuffix(ENV["BASE_URL"], "/") + path
+}
+
+func apiSignHandler(w http.ResponseWriter, req *http.Request) {
+	if signingKey("pixel") == "" {
+		jsonError(w, "Signed pixels need PIXEL_SIGNING_KEY to be set", http.StatusNotImplemented)
+		return
+	}
+	sign := new(SignJSON)
+	if !bind(w, req, sign) {
+		return
+	}
+	path, expires := SignPixel(siteFor(req), sign.Object, sign.TTL)
+	sign.URL = pixelURL(path)
+	if !expires.IsZero() {
+		sign.Expires = expires.Unix()
+	}
+
+	js, _ := json.MarshalIndent(sign, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// signCommand implements `beacon sign [-site name] <objectID> [ttl]`,
+// printing a signed tracking image URL.
+func signCommand(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	siteName := flags.String("site", "", "the site the object belongs to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: beacon sign [-site name] <objectID> [ttl seconds]")
+	}
+	if signingKey("pixel") == "" {
+		return fmt.Errorf("PIXEL_SIGNING_KEY must be set to sign pixels")
+	}
+	var ttl int64
+	if len(args) == 2 {
+		var err error
+		if ttl, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return fmt.Errorf("ttl must be a number of seconds")
+		}
+	}
+	path, _ := SignPixel(&Site{Name: *siteName}, args[0], ttl)
+	fmt.Println(pixelURL(path))
+	return nil
+}
@@ -0,0 +1,55 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"sync"
+)
+
+var startTracker sync.Once
+
+var _ = Describe("Signed pixels", func() {
+	BeforeEach(func() {
+		startTracker.Do(func() { go Tracker() })
+		ENV["PIXEL_SIGNING_KEY"] = "sekrit"
+		ENV["PIXEL_SIGNING"] = "count"
+	})
+	AfterEach(func() {
+		delete(ENV, "PIXEL_SIGNING_KEY")
+		delete(ENV, "PIXEL_SIGNING")
+		resetRedis()
+	})
+
+	visits := func() int64 {
+		result, _ := Get(DefaultSite, "foo")
+		return result.Visits
+	}
+	unsigned := func() int64 {
+		rejected, _ := GetRejected(DefaultSite, "foo")
+		return rejected["unsigned_hits"]
+	}
+
+	It("should count signed hits as visits", func() {
+		path, _ := SignPixel(DefaultSite, "foo", 60)
+		Expect(request("GET", path, "", "").Code).To(Equal(http.StatusOK))
+		Eventually(visits).Should(Equal(int64(1)))
+		Expect(unsigned()).To(Equal(int64(0)))
+	})
+
+	It("should count unsigned hits separately", func() {
+		Expect(request("GET", "/foo.png", "", "").Code).To(Equal(http.StatusOK))
+		path, _ := SignPixel(DefaultSite, "bar", 60)
+		Expect(request("GET", "/foo.png?"+path[len("/bar.png?"):], "", "").Code).To(Equal(http.StatusOK))
+		Eventually(unsigned).Should(Equal(int64(2)))
+		Expect(visits()).To(Equal(int64(0)))
+	})
+
+	It("should reject unsigned hits when required", func() {
+		ENV["PIXEL_SIGNING"] = "require"
+		Expect(request("GET", "/foo.png", "", "").Code).To(Equal(http.StatusForbidden))
+		path, _ := SignPixel(DefaultSite, "bar", 60)
+		Expect(request("GET", "/foo.png?"+path[len("/bar.png?"):], "", "").Code).To(Equal(http.StatusForbidden))
+	})
+})
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const siteContext contextKey = iota + 1
+
+// Maps each site's hosts to its name, so a request's site can be found without
+// loading them all
+const siteHostsKey = "site_hosts"
+
+var siteNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// A Site is a property with its own keyspace. Requests are served for a site
+// when their Host is one of its Hosts, or when their path starts with
+// /s/<name>; anything else belongs to DefaultSite, whose keys are unprefixed.
+type Site struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Origins allowed to make cross-origin reads and pixel requests; any by
+	// default. CORS overrides them for a route group.
+	Origins []string              `json:"origins,omitempty"`
+	CORS    map[string]CORSPolicy `json:"cors,omitempty"`
+
+	// Settings for the uid cookie; the defaults are the request's host and
+	// cookieMaxAge
+	CookieDomain string `json:"cookie_domain,omitempty"`
+	CookieMaxAge int    `json:"cookie_max_age,omitempty"`
+
+	// Days to keep daily and per period stats; periodTTL by default
+	Retention int `json:"retention,omitempty"`
+}
+
+var DefaultSite = &Site{}
+
+func (site *Site) FieldMap() binding.FieldMap {
+	return binding.FieldMap{
+		&site.Name:         binding.Field{Form: "name", Required: true},
+		&site.Hosts:        "hosts",
+		&site.Origins:      "origins",
+		&site.CookieDomain: "cookie_domain",
+		&site.CookieMaxAge: "cookie_max_age",
+		&site.Retention:    "retention",
+	}
+}
+
+func (site *Site) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	if !siteNamePattern.MatchString(site.Name) {
+		errs.Add([]string{"name"}, "ComplexError", "name must be lowercase letters, digits and dashes")
+	}
+	for group, policy := range site.CORS {
+		if !isRouteGroup(group) {
+			errs.Add([]string{"cors"}, "ComplexError", "cors groups must be one of "+strings.Join(routeGroups, ", "))
+		} else if policy.Credentials && allowsAnyOrigin(policy.Origins) {
+			errs.Add([]string{"cors"}, "ComplexError", "cors credentials can't be allowed for any origin")
+		}
+	}
+	if site.CookieMaxAge < 0 || site.Retention < 0 {
+		errs.Add([]string{"cookie_max_age", "retention"}, "ComplexError", "cookie_max_age and retention must not be negative")
+	}
+	return errs
+}
+
+// prefix is prepended to every key of the site.
+func (site *Site) prefix() string {
+	if site.Name == "" {
+		return ""
+	}
+	return site.Name + ":"
+}
+
+// Conn returns a connection from RedisPool confined to the site's keyspace.
+func (site *Site) Conn() redis.Conn {
+	return site.wrap(RedisPool.Get())
+}
+
+func (site *Site) wrap(conn redis.Conn) redis.Conn {
+	if site.prefix() == "" {
+		return conn
+	}
+	return prefixConn{conn, site.prefix()}
+}
+
+// path is where p is served for the site, regardless of the host.
+func (site *Site) path(p string) string {
+	if site.Name == "" {
+		return p
+	}
+	return "/s/" + site.Name + p
+}
+
+// periodTTL is how long, in seconds, the site keeps time bucketed stats.
+func (site *Site) periodTTL() int64 {
+	if site.Retention > 0 {
+		return int64(site.Retention) * 24 * 60 * 60
+	}
+	return periodTTL
+}
+
+func (site *Site) cookieMaxAge() int {
+	if site.CookieMaxAge > 0 {
+		return site.CookieMaxAge
+	}
+	return cookieMaxAge
+}
+
+// prefixConn prepends a prefix to the keys of every command. Scripts build
+// their own keys, so they are left alone and passed the prefix instead.
+type prefixConn struct {
+	redis.Conn
+	prefix string
+}
+
+func (conn prefixConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return conn.Conn.Do(command, conn.prefixKeys(command, args)...)
+}
+
+func (conn prefixConn) Send(command string, args ...interface{}) error {
+	return conn.Conn.Send(command, conn.prefixKeys(command, args)...)
+}
+
+func (conn prefixConn) prefixKeys(command string, args []interface{}) []interface{} {
+	if len(args) == 0 {
+		return args
+	}
+	prefixed := make([]interface{}, len(args))
+	copy(prefixed, args)
+	key := func(i int) {
+		prefixed[i] = conn.prefix + fmt.Sprint(args[i])
+	}
+
+	switch strings.ToUpper(command) {
+	case "EVAL", "EVALSHA", "SCRIPT", "FLUSHALL", "FLUSHDB":
+	case "DEL", "EXISTS", "MGET", "PFCOUNT", "PFMERGE", "SINTER", "SUNION", "WATCH":
+		for i := range args {
+			key(i)
+		}
+	case "MSET":
+		for i := 0; i < len(args); i += 2 {
+			key(i)
+		}
+	case "ZUNIONSTORE", "ZINTERSTORE":
+		key(0)
+		if numkeys, err := strconv.Atoi(fmt.Sprint(args[1])); err == nil {
+			for i := 2; i < 2+numkeys && i < len(args); i++ {
+				key(i)
+			}
+		}
+	case "SINTERCARD":
+		for i := 1; i < len(args); i++ {
+			if s, ok := args[i].(string); ok && strings.ToUpper(s) == "LIMIT" {
+				break
+			}
+			key(i)
+		}
+	default:
+		key(0)
+	}
+	return prefixed
+}
+
+func loadSites(conn redis.Conn) ([]*Site, error) {
+	values, err := redis.Strings(conn.Do("HVALS", "sites"))
+	if err != nil {
+		return nil, err
+	}
+	sites := []*Site{}
+	for _, value := range values {
+		site := new(Site)
+		if err := json.Unmarshal([]byte(value), site); err == nil {
+			sites = append(sites, site)
+		}
+	}
+	sort.Sort(sitesByName(sites))
+	return sites, nil
+}
+
+// loadSite returns the named site, or nil if there is none.
+func loadSite(conn redis.Conn, name string) (*Site, error) {
+	js, err := redis.Bytes(conn.Do("HGET", "sites", name))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	site := new(Site)
+	return site, json.Unmarshal(js, site)
+}
+
+type sitesByName []*Site
+
+func (s sitesByName) Len() int           { return len(s) }
+func (s sitesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sitesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// resolveSite finds the site a request is for, stripping the /s/<name> path
+// segment if it is there. A nil site means the named site doesn't exist.
+func resolveSite(req *http.Request) (*Site, error) {
+	conn := RedisPool.Get()
+	defer conn.Close()
+
+	if strings.HasPrefix(req.URL.Path, "/s/") {
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/s/"), "/", 2)
+		req.URL.Path = "/"
+		if len(parts) == 2 {
+			req.URL.Path += parts[1]
+		}
+		return loadSite(conn, parts[0])
+	}
+
+	name, err := redis.String(conn.Do("HGET", siteHostsKey, strings.ToLower(hostname(req.Host))))
+	if err == redis.ErrNil {
+		return DefaultSite, nil
+	} else if err != nil {
+		return nil, err
+	}
+	site, err := loadSite(conn, name)
+	if site == nil && err == nil {
+		site = DefaultSite
+	}
+	return site, err
+}
+
+// siteHandler resolves the site of every request for siteFor, and applies its
+// CORS policy for the request's route group.
+func siteHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		site, err := resolveSite(req)
+		if err != nil {
+			fmt.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if site == nil {
+			http.NotFound(w, req)
+			return
+		}
+		context.Set(req, siteContext, site)
+		handler := h
+		if c := site.cors(routeGroup(req)); c != nil {
+			handler = c.Handler(h)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// siteFor is the site a request was resolved to.
+func siteFor(req *http.Request) *Site {
+	if site, ok := context.Get(req, siteContext).(*Site); ok {
+		return site
+	}
+	return DefaultSite
+}
+
+// SaveSite creates or replaces a site. Its stats are kept if it is saved
+// again under the same name. A host already claimed by another site is taken
+// over.
+func SaveSite(site Site) error {
+	conn := RedisPool.Get()
+	defer conn.Close()
+
+	stale, err := ownHosts(conn, site.Name)
+	if err != nil {
+		return err
+	}
+	js, _ := json.Marshal(site)
+	conn.Send("MULTI")
+	for _, host := range stale {
+		conn.Send("HDEL", siteHostsKey, host)
+	}
+	for _, host := range site.Hosts {
+		conn.Send("HSET", siteHostsKey, strings.ToLower(host), site.Name)
+	}
+	conn.Send("HSET", "sites", site.Name, js)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// DeleteSite forgets a site, returning redis.ErrNil if there is none. Its
+// keys are left for Redis eviction, or to be picked up by a site of the same
+// name.
+func DeleteSite(name string) error {
+	conn := RedisPool.Get()
+	defer conn.Close()
+
+	hosts, err := ownHosts(conn, name)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	for _, host := range hosts {
+		conn.Send("HDEL", siteHostsKey, host)
+	}
+	conn.Send("HDEL", "sites", name)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if deleted, _ := redis.Int(replies[len(replies)-1], nil); deleted == 0 {
+		return redis.ErrNil
+	}
+	return nil
+}
+
+// ownHosts are the hosts the named site is currently found by.
+func ownHosts(conn redis.Conn, name string) (hosts []string, err error) {
+	site, err := loadSite(conn, name)
+	if site == nil || len(site.Hosts) == 0 {
+		return nil, err
+	}
+	for _, host := range site.Hosts {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+	owners, err := redis.Strings(conn.Do("HMGET", redis.Args{siteHostsKey}.AddFlat(hosts)...))
+	if err != nil {
+		return nil, err
+	}
+	own := hosts[:0]
+	for i, owner := range owners {
+		if owner == name {
+			own = append(own, hosts[i])
+		}
+	}
+	return own, nil
+}
+
+// requireDefaultSite keeps the sites themselves out of reach of the sites'
+// own keys.
+func requireDefaultSite(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if siteFor(req) != DefaultSite {
+			jsonError(w, "Sites are managed from the default site", http.StatusNotFound)
+			return
+		}
+		h(w, req)
+	}
+}
+
+func apiSitesHandler(w http.ResponseWriter, req *http.Request) {
+	conn := RedisPool.Get()
+	defer conn.Close()
+
+	sites, err := loadSites(conn)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(sites, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiSiteWriteHandler(w http.ResponseWriter, req *http.Request) {
+	site := new(Site)
+	if !bind(w, req, site) {
+		return
+	}
+	if err := SaveSite(*site); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := RedisPool.Get()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "save_site", "", site.Name); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiSiteDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if err := DeleteSite(name); err == redis.ErrNil {
+		jsonError(w, "No such site", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := RedisPool.Get()
+	defer conn.Close()
+	if err := recordAudit(conn, req, "delete_site", "", name); err != nil {
+		fmt.Print(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package main_test
+
+import (
+	"encoding/json"
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Sites", func() {
+	acme := &Site{Name: "acme", Hosts: []string{"stats.acme.com"}}
+
+	BeforeEach(func() {
+		SaveSite(*acme)
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for _, user := range []string{"jelder", "cmbt", "jelder"} {
+			event := Event{Site: acme, Object: "foo", User: user}
+			event.Track(conn)
+		}
+		trackSomeEvents()
+	})
+	AfterEach(resetRedis)
+
+	It("should keep each site's stats apart", func() {
+		result, _ := Get(acme, "foo")
+		Expect(result).To(Equal(TrackJSON{Visits: 3, Uniques: 2}))
+		result, _ = Get(DefaultSite, "foo")
+		Expect(result).To(Equal(TrackJSON{Visits: 20, Uniques: 2}))
+
+		result, _ = GetMulti(acme, []string{"foo", "bar"}, false)
+		Expect(result).To(Equal(TrackJSON{Visits: 3, Uniques: 2}))
+		objects, _ := GetObjects(acme, "", "", 10)
+		Expect(objects.Objects).To(HaveLen(1))
+	})
+
+	It("should resolve a site from a path segment", func() {
+		var result TrackJSON
+		w := request("GET", "/s/acme/api/v1/foo", "", "")
+		json.Unmarshal(w.Body.Bytes(), &result)
+		Expect(result.Visits).To(Equal(int64(3)))
+
+		Expect(request("GET", "/s/nope/api/v1/foo", "", "").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should resolve a site from the host", func() {
+		var result TrackJSON
+		req, _ := http.NewRequest("GET", "http://stats.acme.com:8080/api/v1/foo", nil)
+		w := httptest.NewRecorder()
+		Router().ServeHTTP(w, req)
+		json.Unmarshal(w.Body.Bytes(), &result)
+		Expect(result.Visits).To(Equal(int64(3)))
+	})
+
+	It("should follow a site's hosts as they change", func() {
+		host := func(url string) int64 {
+			var result TrackJSON
+			req, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			Router().ServeHTTP(w, req)
+			json.Unmarshal(w.Body.Bytes(), &result)
+			return result.Visits
+		}
+		SaveSite(Site{Name: "acme", Hosts: []string{"Analytics.acme.com"}})
+		Expect(host("http://analytics.acme.com/api/v1/foo")).To(Equal(int64(3)))
+		Expect(host("http://stats.acme.com/api/v1/foo")).To(Equal(int64(20)))
+
+		Expect(DeleteSite("acme")).To(Succeed())
+		Expect(host("http://analytics.acme.com/api/v1/foo")).To(Equal(int64(20)))
+		Expect(DeleteSite("acme")).To(MatchError("redigo: nil returned"))
+	})
+
+	It("should only accept a site's own API keys", func() {
+		key, _ := CreateAPIKey(acme, "importer", "write")
+		body := `{"visits": 10, "uniques": 5}`
+		Expect(authorizedRequest("POST", "/s/acme/api/v1/foo", key.Key, body).Code).To(Equal(http.StatusOK))
+		Expect(authorizedRequest("POST", "/api/v1/foo", key.Key, body).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should only be managed from the default site", func() {
+		ENV["SECRET_KEY"] = "sekrit"
+		defer delete(ENV, "SECRET_KEY")
+
+		w := authorizedRequest("GET", "/s/acme/api/v1/_sites", "sekrit", "")
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+
+		w = authorizedRequest("POST", "/api/v1/_sites", "sekrit", `{"name": "globex", "retention": 30}`)
+		Expect(w.Code).To(Equal(http.StatusNoContent))
+		var sites []Site
+		w = authorizedRequest("GET", "/api/v1/_sites", "sekrit", "")
+		json.Unmarshal(w.Body.Bytes(), &sites)
+		Expect(sites).To(HaveLen(2))
+		Expect(sites[1].Retention).To(Equal(30))
+	})
+})
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+
+	// Time buckets outlive their period by a couple of months
+	periodTTL = 60 * 60 * 24 * 62
+)
+
+var periods = []string{"day", "week", "month"}
+
+type TopObjectJSON struct {
+	ID      string `json:"id"`
+	Visits  int64  `json:"visits"`
+	Uniques int64  `json:"uniques"`
+}
+
+type TopJSON struct {
+	Period  string          `json:"period"`
+	Start   string          `json:"start"`
+	Objects []TopObjectJSON `json:"objects"`
+}
+
+// periodStart returns the start of the calendar day, week (from Monday) or
+// month containing t.
+func periodStart(period string, t time.Time) (time.Time, error) {
+	t = t.UTC().Truncate(24 * time.Hour)
+	switch period {
+	case "day":
+		return t, nil
+	case "week":
+		return week(t), nil
+	case "month":
+		return t.AddDate(0, 0, 1-t.Day()), nil
+	}
+	return t, fmt.Errorf("period must be one of %s", strings.Join(periods, ", "))
+}
+
+func topKey(period string, start time.Time) string {
+	return "top_" + period + "_" + day(start)
+}
+
+func dayHllKey(objectID, date string) string {
+	return "dayhll_" + date + "_" + objectID
+}
+
+func trackTop(conn redis.Conn, event *Event) {
+	for _, period := range periods {
+		start, _ := periodStart(period, event.time())
+		conn.Send("ZINCRBY", topKey(period, start), 1, event.Object)
+		conn.Send("EXPIRE", topKey(period, start), event.site().periodTTL())
+	}
+	date := day(event.time())
+	conn.Send("PFADD", dayHllKey(event.Object, date), event.User)
+	conn.Send("EXPIRE", dayHllKey(event.Object, date), event.site().periodTTL())
+}
+
+func apiTopHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	period := query.Get("period")
+	if period == "" {
+		period = "day"
+	}
+	limit := defaultTopLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxTopLimit {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := periodStart(period, time.Now()); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var hidden []string
+	if ok, err := canReadAll(req); err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		conn := siteFor(req).Conn()
+		hidden, err = privatePatterns(conn)
+		conn.Close()
+		if err != nil {
+			fmt.Print(err)
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response, err := getTop(siteFor(req), period, time.Now(), limit, query.Get("prefix"), hidden)
+	if err != nil {
+		fmt.Print(err)
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.MarshalIndent(response, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// GetTop ranks the objects with the most visits in the period containing now,
+// optionally only those whose IDs start with prefix. Uniques are only counted
+// for the objects returned.
+func GetTop(site *Site, period string, now time.Time, limit int, prefix string) (tj TopJSON, err error) {
+	return getTop(site, period, now, limit, prefix, nil)
+}
+
+// getTop skips objects matching any of the hidden private patterns.
+func getTop(site *Site, period string, now time.Time, limit int, prefix string, hidden []string) (tj TopJSON, err error) {
+	conn := site.Conn()
+	defer conn.Close()
+
+	start, err := periodStart(period, now)
+	if err != nil {
+		return tj, err
+	}
+	tj = TopJSON{Period: period, Start: day(start), Objects: []TopObjectJSON{}}
+
+	// Unfiltered, the leaders are simply the first limit. Otherwise the whole
+	// ranking is fetched at once and filtered here, rather than paged through
+	// a round trip at a time.
+	stop := limit - 1
+	if prefix != "" || len(hidden) > 0 {
+		stop = -1
+	}
+	ranked, err := redis.Values(conn.Do("ZREVRANGE", topKey(period, start), 0, stop, "WITHSCORES"))
+	if err != nil {
+		return tj, err
+	}
+	for len(ranked) > 0 && len(tj.Objects) < limit {
+		var object TopObjectJSON
+		if ranked, err = redis.Scan(ranked, &object.ID, &object.Visits); err != nil {
+			return tj, err
+		}
+		if strings.HasPrefix(object.ID, prefix) && !isPrivate(hidden, object.ID) {
+			tj.Objects = append(tj.Objects, object)
+		}
+	}
+
+	dates := days(start, now.UTC())
+	for _, object := range tj.Objects {
+		hllKeys := []string{}
+		for _, date := range dates {
+			hllKeys = append(hllKeys, dayHllKey(object.ID, date))
+		}
+		conn.Send("PFCOUNT", redis.Args{}.AddFlat(hllKeys)...)
+	}
+	conn.Flush()
+	for i := range tj.Objects {
+		if tj.Objects[i].Uniques, err = redis.Int64(conn.Receive()); err != nil {
+			return tj, err
+		}
+	}
+	return tj, nil
+}
@@ -0,0 +1,55 @@
+package main_test
+
+import (
+	. "github.com/jelder/beacon"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Top objects", func() {
+	now := time.Date(2015, 3, 18, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		conn := RedisPool.Get()
+		defer conn.Close()
+		for i := 0; i < 150; i++ {
+			for j := 0; j < 6; j++ {
+				event := Event{Object: "page_" + strconv.Itoa(i), User: "jelder", Time: now}
+				event.Track(conn)
+			}
+		}
+		for i, visits := range []int{5, 3, 4} {
+			for j := 0; j < visits; j++ {
+				event := Event{Object: "post_" + strconv.Itoa(i), User: strconv.Itoa(j), Time: now}
+				event.Track(conn)
+			}
+		}
+		lastMonth := Event{Object: "post_9", User: "jelder", Time: now.AddDate(0, -1, 0)}
+		lastMonth.Track(conn)
+	})
+	AfterEach(resetRedis)
+
+	It("should rank objects by visits in the period", func() {
+		result, _ := GetTop(DefaultSite, "day", now, 3, "")
+		Expect(result.Objects).To(HaveLen(3))
+		Expect(result.Objects[0].Visits).To(Equal(int64(6)))
+		Expect(result.Objects[0].Uniques).To(Equal(int64(1)))
+	})
+
+	It("should filter by prefix", func() {
+		result, _ := GetTop(DefaultSite, "week", now, 2, "post_")
+		Expect(result.Start).To(Equal("2015-03-16"))
+		Expect(result.Objects).To(Equal([]TopObjectJSON{
+			{ID: "post_0", Visits: 5, Uniques: 5},
+			{ID: "post_2", Visits: 4, Uniques: 4},
+		}))
+	})
+
+	It("should find objects ranked past the first batch", func() {
+		result, _ := GetTop(DefaultSite, "month", now, 10, "post_")
+		Expect(result.Objects).To(HaveLen(3))
+		Expect(result.Objects[2].ID).To(Equal("post_1"))
+	})
+})
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	dateFormat       = "2006-01-02"
+	defaultRangeDays = 30
 )
 
 func mustReadFile(path string) (b []byte) {
@@ -11,3 +22,80 @@ func mustReadFile(path string) (b []byte) {
 	}
 	return b
 }
+
+// stringMap converts an HGETALL reply into a map, in the style of the redigo
+// reply helpers.
+func stringMap(reply interface{}, err error) (map[string]string, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("stringMap expects an even number of values, got %d", len(values))
+	}
+	m := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		m[values[i]] = values[i+1]
+	}
+	return m, nil
+}
+
+// remoteAddr is the client's IP address, as reported by the Heroku router if
+// there is one. The router appends it to any X-Forwarded-For the client sent,
+// so only the last entry can be trusted.
+func remoteAddr(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// hostname strips any port from host.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format(dateFormat)
+}
+
+// days returns every date from from through to, inclusive.
+func days(from, to time.Time) (dates []string) {
+	for t := from.UTC(); !t.After(to); t = t.AddDate(0, 0, 1) {
+		dates = append(dates, day(t))
+	}
+	return dates
+}
+
+// parseDateRange reads the inclusive from and to dates (YYYY-MM-DD) of a
+// report, defaulting to the last thirty days.
+func parseDateRange(req *http.Request) (from, to time.Time, err error) {
+	query := req.URL.Query()
+	to = time.Now().UTC().Truncate(24 * time.Hour)
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(dateFormat, s); err != nil {
+			return from, to, fmt.Errorf("to must be a date like %s", dateFormat)
+		}
+	}
+	from = to.AddDate(0, 0, 1-defaultRangeDays)
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(dateFormat, s); err != nil {
+			return from, to, fmt.Errorf("from must be a date like %s", dateFormat)
+		}
+	}
+	if from.After(to) {
+		return from, to, fmt.Errorf("from must not be after to")
+	}
+	if to.Sub(from) > 366*24*time.Hour {
+		return from, to, fmt.Errorf("date range must not exceed a year")
+	}
+	return from, to, nil
+}